@@ -9,41 +9,86 @@ func appendMulti(out []byte, t int) []byte {
 	return out
 }
 
-func compress(in []byte) (out []byte, sz int) {
-	var m_off int
+// Compress in appending to out, and return the extended buffer, the number
+// of trailing bytes that were left to be emitted as literals, and the index
+// in out of the byte that will hold the length of a following short literal
+// run.
+//
+// The dictionary is a hash table of a power of two size, that stores
+// positions offset by base; entries not greater than base belong to previous
+// inputs, and are ignored. The first dictLen bytes of in are a preset
+// dictionary, that is not compressed but can be referenced by matches.
+//
+// The instructions are encoded for the variant v. If rle is true (only for
+// LZO1X), runs of zeros are encoded with the LZO-RLE instruction, and M4
+// matches avoid the offset and lengths that would be mistaken for it.
+//
+// The emitted instructions are counted in st.
+func compress(out []byte, in []byte, dictLen int, dict []int32, base int, v variant, rle bool, st *Stats) ([]byte, int, int) {
+	var m_off, last_off int
+	m2MaxOffset, m2MaxLen := v.m2MaxOffset(), v.m2MaxLen()
 	in_len := len(in)
-	ip_len := in_len - m2_MAX_LEN - 5
-	dict := make([]int32, 1<<d_BITS)
-	ii := 0
-	ip := 4
+	ip_len := in_len - m2MaxLen - 5
+	max_off := m4_MAX_OFFSET
+	if rle {
+		max_off = m4_MAX_OFFSET_V1
+	}
+	mask := len(dict) - 1
+	high := (mask >> 1) + 1
+	state := len(out) - 2
+	for ip := 0; ip < dictLen && ip+3 < in_len; ip++ {
+		dict[dindex(in, ip, mask)] = int32(base + ip + 1)
+	}
+	ii := dictLen
+	ip := dictLen + 4
 	for {
-		key := int(in[ip+3])
-		key = (key << 6) ^ int(in[ip+2])
-		key = (key << 5) ^ int(in[ip+1])
-		key = (key << 5) ^ int(in[ip+0])
-		dindex := ((0x21 * key) >> 5) & d_MASK
-		m_pos := int(dict[dindex]) - 1
+		if rle && in[ip] == 0 && in[ip+1] == 0 && in[ip+2] == 0 && in[ip+3] == 0 {
+			run := zr_MIN_LEN
+			for run < zr_MAX_LEN && ip+run < in_len && in[ip+run] == 0 {
+				run++
+			}
+			out = storeLiterals(out, in[ii:ip], state, st)
+
+			// An M4 match with distance 0xbfff, with the length of the run
+			// stored in the length bits and in the last byte.
+			run -= zr_MIN_LEN
+			out = append(out,
+				byte(m4_MARKER|8|(run&7)),
+				0xfc,
+				0xff,
+				byte(run>>3))
+			state = len(out) - 3
+			ip += run + zr_MIN_LEN
+			ii = ip
+			if ip >= ip_len {
+				break
+			}
+			continue
+		}
+
+		dindex := dindex(in, ip, mask)
+		m_pos := int(dict[dindex]) - base - 1
 		if m_pos < 0 {
 			goto literal
 		}
-		if ip == m_pos || (ip-m_pos) > m4_MAX_OFFSET {
+		if ip == m_pos || (ip-m_pos) > max_off {
 			goto literal
 		}
 		m_off = ip - m_pos
-		if m_off <= m2_MAX_OFFSET || in[m_pos+3] == in[ip+3] {
+		if m_off <= m2MaxOffset || in[m_pos+3] == in[ip+3] {
 			goto try_match
 		}
 
-		dindex = (dindex & (d_MASK & 0x7ff)) ^ (d_HIGH | 0x1f)
-		m_pos = int(dict[dindex]) - 1
+		dindex = (dindex & (mask & 0x7ff)) ^ (high | 0x1f)
+		m_pos = int(dict[dindex]) - base - 1
 		if m_pos < 0 {
 			goto literal
 		}
-		if ip == m_pos || (ip-m_pos) > m4_MAX_OFFSET {
+		if ip == m_pos || (ip-m_pos) > max_off {
 			goto literal
 		}
 		m_off = ip - m_pos
-		if m_off <= m2_MAX_OFFSET || in[m_pos+3] == in[ip+3] {
+		if m_off <= m2MaxOffset || in[m_pos+3] == in[ip+3] {
 			goto try_match
 		}
 
@@ -55,7 +100,7 @@ func compress(in []byte) (out []byte, sz int) {
 		}
 
 	literal:
-		dict[dindex] = int32(ip + 1)
+		dict[dindex] = int32(base + ip + 1)
 		ip += 1 + (ip-ii)>>5
 		if ip >= ip_len {
 			break
@@ -63,79 +108,67 @@ func compress(in []byte) (out []byte, sz int) {
 		continue
 
 	match:
-		dict[dindex] = int32(ip + 1)
+		dict[dindex] = int32(base + ip + 1)
 		if ip != ii {
-			t := ip - ii
-			if t <= 3 {
-				out[len(out)-2] |= byte(t)
-			} else if t <= 18 {
-				out = append(out, byte(t-3))
-			} else {
-				out = append(out, 0)
-				out = appendMulti(out, t-18)
-			}
-
-			out = append(out, in[ii:ii+t]...)
-			ii += t
+			out = storeLiterals(out, in[ii:ip], state, st)
+			ii = ip
 		}
 
 		var i int
 		ip += 3
-		for i = 3; i < 9; i++ {
+		for i = 3; i < m2MaxLen+1; i++ {
 			ip++
 			if in[m_pos+i] != in[ip-1] {
 				break
 			}
 		}
-		if i < 9 {
+		if i < m2MaxLen+1 {
 			ip--
-			m_len := ip - ii
-			if m_off <= m2_MAX_OFFSET {
-				m_off -= 1
-				out = append(out,
-					byte((((m_len - 1) << 5) | ((m_off & 7) << 2))),
-					byte((m_off >> 3)))
-			} else if m_off <= m3_MAX_OFFSET {
-				m_off -= 1
-				out = append(out,
-					byte(m3_MARKER|(m_len-2)),
-					byte((m_off&63)<<2),
-					byte(m_off>>6))
-			} else {
-				m_off -= 0x4000
-				out = append(out,
-					byte(m4_MARKER|((m_off&0x4000)>>11)|(m_len-2)),
-					byte((m_off&63)<<2),
-					byte(m_off>>6))
-			}
 		} else {
-			m := m_pos + m2_MAX_LEN + 1
+			m := m_pos + m2MaxLen + 1
 			for ip < in_len && in[m] == in[ip] {
 				m++
 				ip++
 			}
-			m_len := ip - ii
-			if m_off <= m3_MAX_OFFSET {
-				m_off -= 1
-				if m_len <= 33 {
-					out = append(out, byte(m3_MARKER|(m_len-2)))
-				} else {
-					m_len -= 33
-					out = append(out, byte(m3_MARKER|0))
-					out = appendMulti(out, m_len)
-				}
+		}
+		m_len := ip - ii
+		repeat := v == lzo1z && m_off == last_off
+		last_off = m_off
+		if m_len <= m2MaxLen && (m_off <= m2MaxOffset || repeat) {
+			st.M2Matches++
+			out = appendM2(out, v, m_len, m_off, repeat)
+		} else if m_off <= m3_MAX_OFFSET {
+			st.M3Matches++
+			m_off -= 1
+			if m_len <= m3_MAX_LEN {
+				out = append(out, byte(m3_MARKER|(m_len-2)))
 			} else {
-				m_off -= 0x4000
-				if m_len <= m4_MAX_LEN {
-					out = append(out, byte(m4_MARKER|((m_off&0x4000)>>11)|(m_len-2)))
-				} else {
-					m_len -= m4_MAX_LEN
-					out = append(out, byte(m4_MARKER|((m_off&0x4000)>>11)))
-					out = appendMulti(out, m_len)
+				m_len -= m3_MAX_LEN
+				out = append(out, byte(m3_MARKER|0))
+				out = appendMulti(out, m_len)
+			}
+			out = appendOffset(out, v, m_off)
+		} else {
+			st.M4Matches++
+			m_off -= 0x4000
+			k := (m_off & 0x4000) >> 11
+			if m_len <= m4_MAX_LEN {
+				out = append(out, byte(m4_MARKER|k|(m_len-2)))
+			} else {
+				if rle && m_off&0x403f == 0x403f && m_len >= 261 && m_len <= 264 {
+					// The length byte followed by the offset would
+					// look like a zero run; shorten the match.
+					ip -= m_len - 260
+					m_len = 260
 				}
+				m_len -= m4_MAX_LEN
+				out = append(out, byte(m4_MARKER|k))
+				out = appendMulti(out, m_len)
 			}
-			out = append(out, byte((m_off&63)<<2), byte(m_off>>6))
+			out = appendOffset(out, v, m_off)
 		}
+		state = stateIndex(out, v)
+		st.MatchBytes += ip - ii
 
 		ii = ip
 		if ip >= ip_len {
@@ -143,36 +176,222 @@ func compress(in []byte) (out []byte, sz int) {
 		}
 	}
 
-	sz = in_len - ii
-	return
+	return out, in_len - ii, state
 }
 
-// Compress an input buffer with LZO1X
-func Compress1X(in []byte) (out []byte) {
+// Primary index in the dictionary of the 4 bytes at in[ip:], for a
+// dictionary of mask+1 entries.
+func dindex(in []byte, ip int, mask int) int {
+	key := int(in[ip+3])
+	key = (key << 6) ^ int(in[ip+2])
+	key = (key << 5) ^ int(in[ip+1])
+	key = (key << 5) ^ int(in[ip+0])
+	return ((0x21 * key) >> 5) & mask
+}
+
+// Append a M2 match to out, which for LZO1Z can repeat the offset of the
+// previous match.
+func appendM2(out []byte, v variant, m_len, m_off int, repeat bool) []byte {
+	m_off -= 1
+	switch {
+	case v == lzo1y:
+		return append(out, byte((m_len+1)<<4|(m_off&3)<<2), byte(m_off>>2))
+	case repeat:
+		return append(out, byte((m_len-1)<<5|0x700>>6))
+	case v == lzo1z:
+		return append(out, byte((m_len-1)<<5|m_off>>6), byte(m_off<<2))
+	}
+	return append(out, byte((m_len-1)<<5|(m_off&7)<<2), byte(m_off>>3))
+}
+
+// Append a M1 match to out, with an offset already reduced by its minimum.
+func appendM1(out []byte, v variant, m_off int) []byte {
+	if v == lzo1z {
+		return append(out, byte(m1_MARKER|m_off>>6), byte(m_off<<2))
+	}
+	return append(out, byte(m1_MARKER|(m_off&3)<<2), byte(m_off>>2))
+}
+
+// Append the 14 low bits of the offset of a M3 or M4 match to out.
+func appendOffset(out []byte, v variant, m_off int) []byte {
+	if v == lzo1z {
+		return append(out, byte(m_off>>6), byte(m_off<<2))
+	}
+	return append(out, byte(m_off<<2), byte(m_off>>6))
+}
+
+// Index in out of the byte that holds the length of the literal run that
+// follows the match just appended: the last one for LZO1Z, and the one
+// before it for the other variants.
+func stateIndex(out []byte, v variant) int {
+	if v == lzo1z {
+		return len(out) - 1
+	}
+	return len(out) - 2
+}
+
+// Append a literal run to out. Runs of up to 3 bytes are encoded in the
+// previous instruction, in the byte at index state.
+func storeLiterals(out []byte, lit []byte, state int, st *Stats) []byte {
+	t := len(lit)
+	if t == 0 {
+		return out
+	}
+	st.LiteralBytes += t
+	if t <= 3 {
+		out[state] |= byte(t)
+		st.ShortRuns++
+	} else if t <= 18 {
+		out = append(out, byte(t-3))
+		st.MediumRuns++
+	} else {
+		out = append(out, 0)
+		out = appendMulti(out, t-18)
+		st.LongRuns++
+	}
+	return append(out, lit...)
+}
+
+func compress1X(out []byte, in []byte, dictLen int, dict []int32, base int, v variant, rle bool, st *Stats) []byte {
 	var t int
 
+	if st == nil {
+		st = new(Stats)
+	}
+	start := len(out)
+	if rle {
+		// LZO1X never begins with 17 (except for an empty input, that is
+		// too short to be mistaken), so it marks the bitstream version.
+		out = append(out, 17, 1)
+		start = len(out)
+	}
+	state := len(out) - 2
+
 	in_len := len(in)
-	if in_len <= m2_MAX_LEN+5 {
-		t = in_len
+	if in_len-dictLen <= v.m2MaxLen()+5 {
+		t = in_len - dictLen
 	} else {
-		out, t = compress(in)
+		out, t, state = compress(out, in, dictLen, dict, base, v, rle, st)
 	}
 
 	if t > 0 {
 		ii := in_len - t
-		if len(out) == 0 && t <= 238 {
+		if len(out) == start && t <= 238 {
 			out = append(out, byte(17+t))
-		} else if t <= 3 {
-			out[len(out)-2] |= byte(t)
-		} else if t <= 18 {
-			out = append(out, byte(t-3))
+			out = append(out, in[ii:]...)
+			st.LiteralBytes += t
 		} else {
-			out = append(out, 0)
-			out = appendMulti(out, t-18)
+			out = storeLiterals(out, in[ii:], state, st)
 		}
-		out = append(out, in[ii:ii+t]...)
 	}
 
 	out = append(out, m4_MARKER|1, 0, 0)
-	return
+	return out
+}
+
+// CompressBound returns the maximum size of the compressed output for an
+// input of n bytes, for all the compressors in this package.
+func CompressBound(n int) int {
+	return n + n/16 + 64 + 3
+}
+
+// Compress an input buffer with LZO1X
+func Compress1X(in []byte) (out []byte) {
+	return new(Compressor1X).AppendCompress(nil, in)
+}
+
+// Compress1X11 compresses in with LZO1X-1(11), a variant of LZO1X-1 with
+// a hash table of 2K entries instead of 16K, which uses less memory but
+// compresses less. The output can be decompressed with
+// Decompress1X.
+func Compress1X11(in []byte) []byte {
+	return (&Compressor1X{bits: 11}).AppendCompress(nil, in)
+}
+
+// Compress1X12 compresses in with LZO1X-1(12), a variant of LZO1X-1 with
+// a hash table of 4K entries, like Compress1X11.
+func Compress1X12(in []byte) []byte {
+	return (&Compressor1X{bits: 12}).AppendCompress(nil, in)
+}
+
+// Compress1X15 compresses in with LZO1X-1(15), a variant of LZO1X-1 with
+// a hash table of 32K entries, which compresses slightly better at the cost
+// of more memory. The output can be decompressed with Decompress1X.
+func Compress1X15(in []byte) []byte {
+	return (&Compressor1X{bits: 15}).AppendCompress(nil, in)
+}
+
+// AppendCompress1X compresses src with LZO1X, appending the result to dst,
+// and returns the extended buffer. If dst has at least
+// CompressBound(len(src)) bytes of spare capacity, it is never reallocated.
+func AppendCompress1X(dst, src []byte) []byte {
+	return new(Compressor1X).AppendCompress(dst, src)
+}
+
+// Compress1XDict compresses in with LZO1X-1 like Compress1X, but matches
+// can also reference the preset dictionary dict, which improves the
+// compression of short inputs that resemble it. Only the last 48 KiB of dict
+// can be referenced. The output must be decompressed with Decompress1XDict
+// and the same dictionary.
+func Compress1XDict(in, dict []byte) []byte {
+	if len(dict) > m4_MAX_OFFSET {
+		dict = dict[len(dict)-m4_MAX_OFFSET:]
+	}
+	buf := make([]byte, 0, len(dict)+len(in))
+	buf = append(append(buf, dict...), in...)
+	return compress1X(nil, buf, len(dict), make([]int32, 1<<d_BITS), 0, lzo1x, false, nil)
+}
+
+// Stats describes the instructions emitted by a compressor, to help
+// understanding how well it performs on some data. Matches are classified
+// by their encoding: M1 matches are 2 or 3 bytes long and follow a literal
+// run (M1a after 1 to 3 literals, M1b after more), M2 matches are up to 8
+// bytes long at a distance of up to 2 KiB, M3 matches are within 16 KiB
+// and M4 matches are farther. LZO1X-1 only uses M2, M3 and M4.
+type Stats struct {
+	MatchBytes   int // bytes encoded by matches
+	LiteralBytes int // bytes stored as literals
+	LazyMatches  int // matches deferred to find a better one (LZO1X-999)
+
+	M1aMatches int
+	M1bMatches int
+	M2Matches  int
+	M3Matches  int
+	M4Matches  int
+
+	ShortRuns  int // literal runs of 1 to 3 bytes, stored in the previous match
+	MediumRuns int // literal runs of 4 to 18 bytes
+	LongRuns   int // longer literal runs
+}
+
+// Compress1XStats is like Compress1X, but also returns statistics on the
+// compressed data.
+func Compress1XStats(in []byte) ([]byte, Stats) {
+	var st Stats
+	out := compress1X(nil, in, 0, make([]int32, 1<<d_BITS), 0, lzo1x, false, &st)
+	return out, st
+}
+
+// Compress1Y compresses in with LZO1Y-1, a sibling of LZO1X-1 whose M2
+// matches reach only 1 KiB back but can be 14 bytes long. The output must be
+// decompressed with Decompress1Y.
+func Compress1Y(in []byte) []byte {
+	return compress1X(nil, in, 0, make([]int32, 1<<d_BITS), 0, lzo1y, false, nil)
+}
+
+// Compress1Z compresses in with the LZO1X-1 algorithm, encoding the output as
+// LZO1Z, a sibling of LZO1X whose M2 matches reach 1.75 KiB back or repeat
+// the offset of the previous match. The output must be decompressed with
+// Decompress1Z.
+func Compress1Z(in []byte) []byte {
+	return compress1X(nil, in, 0, make([]int32, 1<<d_BITS), 0, lzo1z, false, nil)
+}
+
+// Compress an input buffer with LZO-RLE, the variant of LZO1X used by the
+// Linux kernel (for instance by zram), that encodes runs of zeros with a
+// special M4 instruction. The output starts with the bitstream version
+// header expected by the kernel, and must be decompressed with
+// Decompress1XRLE.
+func Compress1XRLE(in []byte) (out []byte) {
+	return new(Compressor1X).appendCompress(nil, in, true)
 }
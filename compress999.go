@@ -1,9 +1,17 @@
 package lzo
 
+import (
+	"context"
+	"fmt"
+)
+
 type compressor struct {
-	in []byte
-	ip int
-	bp int
+	v     variant
+	in    []byte
+	dict  []byte // preset dictionary, before in
+	ip    int
+	bp    int
+	start int // length of the output buffer before compression
 
 	// stats
 	matchBytes int
@@ -23,12 +31,13 @@ type compressor struct {
 
 	r1mlen int
 
-	lastmlen int
-	lastmoff int
-	textsize uint
-	mlen     int
-	moff     int
-	look     uint
+	lastmlen   int
+	lastmoff   int
+	textsize   uint
+	printcount uint
+	mlen       int
+	moff       int
+	look       uint
 }
 
 func (ctx *compressor) codeMatch(out []byte, mlen int, moff int) []byte {
@@ -44,34 +53,26 @@ func (ctx *compressor) codeMatch(out []byte, mlen int, moff int) []byte {
 		if ctx.r1lit < 1 || ctx.r1lit >= 4 {
 			panic("codeMatch: mlen 2: r1lit error")
 		}
-		moff -= 1
-		out = append(out,
-			m1_MARKER|byte((moff&3)<<2),
-			byte(moff>>2))
+		out = appendM1(out, ctx.v, moff-1)
 		ctx.m1am++
-	case mlen <= m2_MAX_LEN && moff <= m2_MAX_OFFSET:
+	case mlen <= ctx.v.m2MaxLen() && (moff <= ctx.v.m2MaxOffset() || (ctx.v == lzo1z && moff == ctx.lastmoff)):
 		if mlen < 3 {
 			panic("codeMatch: m2: mlen error")
 		}
-		moff -= 1
-		out = append(out,
-			byte((mlen-1)<<5|(moff&7)<<2),
-			byte(moff>>3))
-		if out[len(out)-2] < m2_MARKER {
+		n := len(out)
+		out = appendM2(out, ctx.v, mlen, moff, ctx.v == lzo1z && moff == ctx.lastmoff)
+		if out[n] < m2_MARKER {
 			panic("codeMatch: m2: invalid marker")
 		}
 		ctx.m2m++
-	case mlen == m2_MIN_LEN && moff <= mX_MAX_OFFSET && ctx.r1lit >= 4:
+	case mlen == m2_MIN_LEN && moff <= ctx.v.mxMaxOffset() && ctx.r1lit >= 4:
 		if mlen != 3 {
 			panic("codeMatch: m2min: invalid mlen")
 		}
-		if moff <= m2_MAX_OFFSET {
+		if moff <= ctx.v.m2MaxOffset() {
 			panic("codeMatch: m2min: invalid moff")
 		}
-		moff -= 1 + m2_MAX_OFFSET
-		out = append(out,
-			byte(m1_MARKER|((moff&3)<<2)),
-			byte(moff>>2))
+		out = appendM1(out, ctx.v, moff-1-ctx.v.m2MaxOffset())
 		ctx.m1bm++
 	case moff <= m3_MAX_OFFSET:
 		if mlen < 3 {
@@ -85,7 +86,7 @@ func (ctx *compressor) codeMatch(out []byte, mlen int, moff int) []byte {
 			out = append(out, byte(m3_MARKER|0))
 			out = appendMulti(out, mlen)
 		}
-		out = append(out, byte(moff<<2), byte(moff>>6))
+		out = appendOffset(out, ctx.v, moff)
 		ctx.m3m++
 	default:
 		if mlen < 3 {
@@ -103,7 +104,7 @@ func (ctx *compressor) codeMatch(out []byte, mlen int, moff int) []byte {
 			out = append(out, byte(m4_MARKER|k|0))
 			out = appendMulti(out, mlen)
 		}
-		out = append(out, byte(moff<<2), byte(moff>>6))
+		out = appendOffset(out, ctx.v, moff)
 		ctx.m4m++
 	}
 
@@ -115,10 +116,10 @@ func (ctx *compressor) codeMatch(out []byte, mlen int, moff int) []byte {
 func (ctx *compressor) storeRun(out []byte, ii int, t int) []byte {
 	ctx.litBytes += t
 
-	if len(out) == 0 && t <= 238 {
+	if len(out) == ctx.start && t <= 238 {
 		out = append(out, byte(17+t))
 	} else if t <= 3 {
-		out[len(out)-2] |= byte(t)
+		out[stateIndex(out, ctx.v)] |= byte(t)
 		ctx.lit1r++
 	} else if t <= 18 {
 		out = append(out, byte(t-3))
@@ -160,9 +161,9 @@ func (ctx *compressor) lenOfCodedMatch(mlen int, moff int, lit int) int {
 			return 2
 		}
 		return 0
-	case mlen <= m2_MAX_LEN && moff <= m2_MAX_OFFSET:
+	case mlen <= ctx.v.m2MaxLen() && moff <= ctx.v.m2MaxOffset():
 		return 2
-	case mlen == m2_MIN_LEN && moff <= mX_MAX_OFFSET && lit >= 4:
+	case mlen == m2_MIN_LEN && moff <= ctx.v.mxMaxOffset() && lit >= 4:
 		return 2
 	case moff <= m3_MAX_OFFSET:
 		if mlen <= m3_MAX_LEN {
@@ -218,18 +219,40 @@ func (ctx *compressor) minGain(ahead int,
 	return mingain
 }
 
-type parms struct {
-	TryLazy  int
-	GoodLen  uint
-	MaxLazy  uint
-	NiceLen  uint
-	MaxChain uint
-	Flags    uint32
+// Params are the tuning parameters of LZO1X-999, that select a trade-off
+// between compression ratio and speed; each Level corresponds to a preset
+// (see Level.Params). GoodLen, MaxLazy, NiceLen and MaxChain select their
+// defaults when zero, which are the maximum values for NiceLen and
+// MaxChain. TryLazy and BestOff have no default: their zero values disable
+// lazy matching and the preference for short offsets.
+type Params struct {
+	TryLazy  int  // number of positions where to look for a better match; 0 disables it, negative means 1
+	GoodLen  int  // match length after which fewer matches are examined (default 32)
+	MaxLazy  int  // match length after which no better match is looked for (default 32)
+	NiceLen  int  // match length after which the search stops, up to 2048
+	MaxChain int  // maximum number of matches examined per position (default 2048)
+	BestOff  bool // prefer shorter matches that can be encoded in fewer bytes
+}
+
+func (p Params) valid() bool {
+	return p.GoodLen >= 0 && p.MaxLazy >= 0 && p.NiceLen >= 0 && p.NiceLen <= cSWD_F && p.MaxChain >= 0
 }
 
-func compress999(in []byte, p parms) []byte {
-	ctx := compressor{}
-	swd := swd{}
+// Optional instrumentation of compress999.
+type hooks struct {
+	stats *Stats // filled with the statistics of the compressed data
+
+	// Called every KiB of input with the number of bytes consumed and
+	// produced, like lzo_callback_t. If it returns an error, which is
+	// stored in err, the compression is aborted.
+	progress func(consumed, produced int) error
+	err      error
+}
+
+// Compress in appending to out, encoding the instructions for the variant
+// v, with the optional hooks h.
+func compress999(swd *swd, out []byte, in []byte, dict []byte, v variant, p Params, h *hooks) []byte {
+	ctx := compressor{v: v}
 
 	if p.TryLazy < 0 {
 		p.TryLazy = 1
@@ -245,21 +268,33 @@ func compress999(in []byte, p parms) []byte {
 	}
 
 	ctx.in = in
+	ctx.start = len(out)
 
-	out := make([]byte, 0, len(in)/2)
 	ii := 0
 	lit := 0
 
-	ctx.initMatch(&swd, p.Flags)
+	if len(dict) > cSWD_N {
+		dict = dict[len(dict)-cSWD_N:]
+	}
+	ctx.dict = dict
+	ctx.initMatch(swd, dict, p.BestOff)
 	if p.MaxChain > 0 {
-		swd.MaxChain = p.MaxChain
+		swd.MaxChain = uint(p.MaxChain)
 	}
 	if p.NiceLen > 0 {
-		swd.NiceLength = p.NiceLen
+		swd.NiceLength = uint(p.NiceLen)
 	}
 
-	ctx.findMatch(&swd, 0, 0)
+	ctx.findMatch(swd, 0, 0)
 	for ctx.look > 0 {
+		if h != nil && h.progress != nil && ctx.textsize > ctx.printcount {
+			if h.err = h.progress(int(ctx.textsize), len(out)-ctx.start); h.err != nil {
+				swd.ctx = nil
+				return out
+			}
+			ctx.printcount += 1024
+		}
+
 		mlen := ctx.mlen
 		moff := ctx.moff
 		if ctx.bp != ctx.ip-int(ctx.look) {
@@ -280,12 +315,12 @@ func compress999(in []byte, p parms) []byte {
 
 		if mlen < 2 ||
 			(mlen == 2 && (moff > m1_MAX_OFFSET || lit == 0 || lit >= 4)) ||
-			(mlen == 2 && len(out) == 0) ||
-			(len(out) == 0 && lit == 0) {
+			(mlen == 2 && len(out) == ctx.start) ||
+			(len(out) == ctx.start && lit == 0) {
 			// literal
 			mlen = 0
 		} else if mlen == m2_MIN_LEN {
-			if moff > mX_MAX_OFFSET && lit >= 4 {
+			if moff > ctx.v.mxMaxOffset() && lit >= 4 {
 				mlen = 0
 			}
 		}
@@ -293,23 +328,23 @@ func compress999(in []byte, p parms) []byte {
 		if mlen == 0 {
 			// literal
 			lit++
-			swd.MaxChain = p.MaxChain
-			ctx.findMatch(&swd, 1, 0)
+			swd.MaxChain = uint(p.MaxChain)
+			ctx.findMatch(swd, 1, 0)
 			continue
 		}
 
 		// a match
 		if swd.UseBestOff {
-			mlen, moff = ctx.betterMatch(&swd, mlen, moff)
+			mlen, moff = ctx.betterMatch(swd, mlen, moff)
 		}
 
-		ctx.assertMatch(&swd, mlen, moff)
+		ctx.assertMatch(swd, mlen, moff)
 
 		// check if we want to try a lazy match
 		ahead := 0
 		l1 := 0
 		maxahead := 0
-		if p.TryLazy != 0 && mlen < int(p.MaxLazy) {
+		if p.TryLazy != 0 && mlen < p.MaxLazy {
 			l1 = ctx.lenOfCodedMatch(mlen, moff, lit)
 			if l1 == 0 {
 				panic("assert: compress: invalid len of coded match")
@@ -322,12 +357,12 @@ func compress999(in []byte, p parms) []byte {
 
 		matchdone := false
 		for ahead < maxahead && int(ctx.look) > mlen {
-			if mlen >= int(p.GoodLen) {
-				swd.MaxChain = p.MaxChain >> 2
+			if mlen >= p.GoodLen {
+				swd.MaxChain = uint(p.MaxChain >> 2)
 			} else {
-				swd.MaxChain = p.MaxChain
+				swd.MaxChain = uint(p.MaxChain)
 			}
-			ctx.findMatch(&swd, 1, 0)
+			ctx.findMatch(swd, 1, 0)
 			ahead++
 			if ctx.look <= 0 {
 				panic("assert: compress: invalid look")
@@ -342,20 +377,20 @@ func compress999(in []byte, p parms) []byte {
 				continue
 			}
 			if swd.UseBestOff {
-				ctx.mlen, ctx.moff = ctx.betterMatch(&swd, ctx.mlen, ctx.moff)
+				ctx.mlen, ctx.moff = ctx.betterMatch(swd, ctx.mlen, ctx.moff)
 			}
 			l2 := ctx.lenOfCodedMatch(ctx.mlen, ctx.moff, lit+ahead)
 			if l2 == 0 {
 				continue
 			}
 			l3 := 0
-			if len(out) > 0 {
+			if len(out) > ctx.start {
 				l3 = ctx.lenOfCodedMatch(ahead, moff, lit)
 			}
 			mingain := ctx.minGain(ahead, lit, lit+ahead, l1, l2, l3)
 			if ctx.mlen >= mlen+mingain {
 				ctx.lazy++
-				ctx.assertMatch(&swd, ctx.mlen, ctx.moff)
+				ctx.assertMatch(swd, ctx.mlen, ctx.moff)
 
 				if l3 > 0 {
 					out = ctx.codeRun(out, ii, lit, ahead)
@@ -380,8 +415,8 @@ func compress999(in []byte, p parms) []byte {
 			out = ctx.codeRun(out, ii, lit, mlen)
 			lit = 0
 			out = ctx.codeMatch(out, mlen, moff)
-			swd.MaxChain = p.MaxChain
-			ctx.findMatch(&swd, uint(mlen), uint(1+ahead))
+			swd.MaxChain = uint(p.MaxChain)
+			ctx.findMatch(swd, uint(mlen), uint(1+ahead))
 		}
 	}
 
@@ -392,23 +427,130 @@ func compress999(in []byte, p parms) []byte {
 	if ctx.litBytes+ctx.matchBytes != len(ctx.in) {
 		panic("assert: compress999: not processed full input")
 	}
+	swd.ctx = nil
+	if h != nil && h.stats != nil {
+		*h.stats = Stats{
+			MatchBytes:   ctx.matchBytes,
+			LiteralBytes: ctx.litBytes,
+			LazyMatches:  ctx.lazy,
+			M1aMatches:   int(ctx.m1am),
+			M1bMatches:   int(ctx.m1bm),
+			M2Matches:    int(ctx.m2m),
+			M3Matches:    int(ctx.m3m),
+			M4Matches:    int(ctx.m4m),
+			ShortRuns:    int(ctx.lit1r),
+			MediumRuns:   int(ctx.lit2r),
+			LongRuns:     int(ctx.lit3r),
+		}
+	}
 	return out
 }
 
-var fixedLevels = [...]parms{
-	{0, 0, 0, 8, 4, 0},
-	{0, 0, 0, 16, 8, 0},
-	{0, 0, 0, 32, 16, 0},
-	{1, 4, 4, 16, 16, 0},
-	{1, 8, 16, 32, 32, 0},
-	{1, 8, 16, 128, 128, 0},
-	{2, 8, 32, 128, 256, 0},
-	{2, 32, 128, cSWD_F, 2048, 1},
-	{2, cSWD_F, cSWD_F, cSWD_F, 4096, 1},
+var fixedLevels = [...]Params{
+	{0, 0, 0, 8, 4, false},
+	{0, 0, 0, 16, 8, false},
+	{0, 0, 0, 32, 16, false},
+	{1, 4, 4, 16, 16, false},
+	{1, 8, 16, 32, 32, false},
+	{1, 8, 16, 128, 128, false},
+	{2, 8, 32, 128, 256, false},
+	{2, 32, 128, cSWD_F, 2048, true},
+	{2, cSWD_F, cSWD_F, cSWD_F, 4096, true},
 }
 
+// Parameters of a LZO1X-999 level, which panics if it is invalid
+func mustParams(level int) Params {
+	p, err := Level(level).Params()
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Compress1X999Level compresses in with LZO1X-999 at the specified level,
+// between 1 and 9. It panics if the level is invalid, like
+// AppendCompress1X999Level: CompressLevel, or Compress1X999Params with the
+// parameters from Level.Params, return an error instead.
 func Compress1X999Level(in []byte, level int) []byte {
-	return compress999(in, fixedLevels[level-1])
+	return compress999(newSwd(), make([]byte, 0, len(in)/2), in, nil, lzo1x, mustParams(level), nil)
+}
+
+// AppendCompress1X999Level compresses src with LZO1X-999 at the specified
+// level, like Compress1X999Level, appending the result to dst. If dst has
+// at least CompressBound(len(src)) bytes of spare capacity, it is never
+// reallocated. It panics if the level is invalid.
+func AppendCompress1X999Level(dst, src []byte, level int) []byte {
+	return compress999(newSwd(), dst, src, nil, lzo1x, mustParams(level), nil)
+}
+
+// Compress1X999LevelStats is like Compress1X999Level, but also returns
+// statistics on the compressed data. An error is returned if the level is
+// invalid.
+func Compress1X999LevelStats(in []byte, level Level) ([]byte, Stats, error) {
+	p, err := level.Params()
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	var st Stats
+	out := compress999(newSwd(), make([]byte, 0, len(in)/2), in, nil, lzo1x, p, &hooks{stats: &st})
+	return out, st, nil
+}
+
+// Compress1X999Params compresses in with LZO1X-999 using custom tuning
+// parameters, which permits finding the best trade-off between ratio and
+// speed for specific data. An error is returned if p is invalid.
+func Compress1X999Params(in []byte, p Params) ([]byte, error) {
+	if !p.valid() {
+		return nil, fmt.Errorf("lzo: invalid LZO1X-999 parameters: %+v", p)
+	}
+	return compress999(newSwd(), make([]byte, 0, len(in)/2), in, nil, lzo1x, p, nil), nil
+}
+
+// Compress1X999LevelDict compresses in with LZO1X-999 at the specified
+// level, like Compress1X999Level, but matches can also reference the preset
+// dictionary dict, like in Compress1XDict. It is compatible with
+// lzo1x_999_compress_level from liblzo. An error is returned if the level is
+// invalid.
+func Compress1X999LevelDict(in, dict []byte, level Level) ([]byte, error) {
+	p, err := level.Params()
+	if err != nil {
+		return nil, err
+	}
+	return compress999(newSwd(), make([]byte, 0, len(in)/2), in, dict, lzo1x, p, nil), nil
+}
+
+// Compress1X999Context is like Compress1X999Level, but stops early,
+// returning ctx.Err(), if the context is canceled. This permits bounding
+// the time spent compressing large inputs at the highest levels. An error
+// is returned if the level is invalid.
+func Compress1X999Context(ctx context.Context, in []byte, level Level) ([]byte, error) {
+	c, err := NewCompressor999(level)
+	if err != nil {
+		return nil, err
+	}
+	return c.CompressContext(ctx, in)
+}
+
+// Compress1Y999Level compresses in with LZO1Y-999 at the specified level,
+// between 1 and 9, like Compress1X999Level, but returns an error if it is
+// invalid. The output must be decompressed with Decompress1Y.
+func Compress1Y999Level(in []byte, level Level) ([]byte, error) {
+	p, err := level.Params()
+	if err != nil {
+		return nil, err
+	}
+	return compress999(newSwd(), make([]byte, 0, len(in)/2), in, nil, lzo1y, p, nil), nil
+}
+
+// Compress1Z999Level compresses in with LZO1Z-999 at the specified level,
+// between 1 and 9, like Compress1X999Level, but returns an error if it is
+// invalid. The output must be decompressed with Decompress1Z.
+func Compress1Z999Level(in []byte, level Level) ([]byte, error) {
+	p, err := level.Params()
+	if err != nil {
+		return nil, err
+	}
+	return compress999(newSwd(), make([]byte, 0, len(in)/2), in, nil, lzo1z, p, nil), nil
 }
 
 func Compress1X999(in []byte) []byte {
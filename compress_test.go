@@ -2,11 +2,14 @@ package lzo
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -124,16 +127,16 @@ func TestDecompInlen(t *testing.T) {
 	for i := 1; i < 16; i++ {
 		for j := -16; j < 16; j++ {
 			_, err := Decompress1X(io.LimitReader(bytes.NewReader(cmp), int64(len(cmp)-i)), len(cmp)+j, 0)
-			if err != io.EOF {
-				t.Error("EOF expected for truncated input, found:", err)
+			if !errors.Is(err, InputOverrun) && !errors.Is(err, EOFNotFound) {
+				t.Error("truncated input error expected, found:", err)
 			}
 		}
 	}
 
 	for j := -16; j < 16; j++ {
 		data2, err := Decompress1X(bytes.NewReader(cmp), len(cmp)+j, 0)
-		if j < 0 && err != io.EOF {
-			t.Error("EOF expected for truncated input, found:", err)
+		if j < 0 && !errors.Is(err, InputOverrun) && !errors.Is(err, EOFNotFound) {
+			t.Error("truncated input error expected, found:", err)
 		}
 		if j >= 0 {
 			if err != nil {
@@ -149,6 +152,12 @@ func Test1(t *testing.T) {
 	testCorpora(t, Compress1X)
 }
 
+func Test1Variants(t *testing.T) {
+	for _, cmpfunc := range []func([]byte) []byte{Compress1X11, Compress1X12, Compress1X15} {
+		testCorpora(t, cmpfunc)
+	}
+}
+
 func Test999(t *testing.T) {
 	maxlevel := 9
 	if testing.Short() {
@@ -184,6 +193,40 @@ func BenchmarkComp(b *testing.B) {
 	}
 }
 
+func BenchmarkComp1XVariants(b *testing.B) {
+	f, err := os.Open("testdata/large.tar.gz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer gz.Close()
+
+	var buf bytes.Buffer
+	io.Copy(&buf, gz)
+
+	for _, bits := range []int{11, 12, 14, 15} {
+		b.Run(fmt.Sprintf("LZO1X-1(%d)", bits), func(b *testing.B) {
+			c, err := NewCompressor1X(bits)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var cmp []byte
+			b.SetBytes(int64(buf.Len()))
+			for i := 0; i < b.N; i++ {
+				c.Reset()
+				cmp = c.AppendCompress(cmp[:0], buf.Bytes())
+			}
+			b.ReportMetric(float64(len(cmp))*100/float64(buf.Len()), "%size")
+		})
+	}
+}
+
 func BenchmarkDecomp(b *testing.B) {
 	f, err := os.Open("testdata/large.tar.gz")
 	if err != nil {
@@ -207,3 +250,377 @@ func BenchmarkDecomp(b *testing.B) {
 		Decompress1X(bytes.NewReader(cmp), len(cmp), buf.Len())
 	}
 }
+
+func BenchmarkDecompInto(b *testing.B) {
+	f, err := os.Open("testdata/large.tar.gz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer gz.Close()
+
+	var buf bytes.Buffer
+	io.Copy(&buf, gz)
+
+	cmp := Compress1X(buf.Bytes())
+	out := make([]byte, buf.Len())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Decompress1XInto(out, cmp)
+	}
+}
+
+// Throughput of Decompress1X on the readers it handles differently,
+// compared with the one of Decompress1XInto on a slice.
+func BenchmarkDecompReaders(b *testing.B) {
+	f, err := os.Open("testdata/large.tar.gz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer gz.Close()
+
+	var buf bytes.Buffer
+	io.Copy(&buf, gz)
+
+	cmp := Compress1X(buf.Bytes())
+	for _, tc := range []struct {
+		name  string
+		inLen int
+		r     func() io.Reader
+	}{
+		{"bytes.Reader", len(cmp), func() io.Reader { return bytes.NewReader(cmp) }},
+		{"bufio.Reader", 0, func() io.Reader { return bufio.NewReader(bytes.NewReader(cmp)) }},
+		{"bytes.Buffer", 0, func() io.Reader { return bytes.NewBuffer(cmp) }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(int64(buf.Len()))
+			for i := 0; i < b.N; i++ {
+				if _, err := Decompress1X(tc.r(), tc.inLen, buf.Len()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("slice", func(b *testing.B) {
+		out := make([]byte, buf.Len())
+		b.SetBytes(int64(buf.Len()))
+		for i := 0; i < b.N; i++ {
+			if _, err := Decompress1XInto(out, cmp); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRLE(t *testing.T) {
+	var data []byte
+	for i, n := range []int{0, 1, 3, 4, 5, 17, 300, 2050, 2051, 2052, 10000} {
+		data = append(data, bytes.Repeat([]byte{byte(i + 1)}, i*7)...)
+		data = append(data, make([]byte, n)...)
+	}
+	data = append(data, make([]byte, 20000)...)
+
+	for _, in := range [][]byte{nil, data[:3], data[:20], data} {
+		cmp := Compress1XRLE(in)
+		if cmp[0] != 17 || cmp[1] != 1 {
+			t.Error("missing bitstream version header")
+		}
+		data2, err := Decompress1XRLE(bytes.NewReader(cmp), len(cmp), 0)
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(in, data2) {
+			t.Error("data doesn't match after decompression")
+		}
+	}
+
+	// Zero runs are encoded in 4 bytes each
+	cmp := Compress1XRLE(data)
+	if len(cmp) > len(Compress1X(data)) {
+		t.Error("LZO-RLE compresses zeros worse than LZO1X")
+	}
+
+	// Plain LZO1X streams are accepted too
+	cmp = Compress1X(data)
+	data2, err := Decompress1XRLE(bytes.NewReader(cmp), len(cmp), 0)
+	if err != nil || !bytes.Equal(data, data2) {
+		t.Error("LZO1X stream not decoded by LZO-RLE decoder:", err)
+	}
+}
+
+func TestRLEDecompress(t *testing.T) {
+	// "abcd" followed by a run of 100 zeros, as the kernel would encode it
+	cmp := []byte{17, 1, 17 + 4, 'a', 'b', 'c', 'd', 0x18 | (96 & 7), 0xfc, 0xff, 96 >> 3, 17, 0, 0}
+	out, err := Decompress1XRLE(bytes.NewReader(cmp), len(cmp), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, append([]byte("abcd"), make([]byte, 100)...)) {
+		t.Error("invalid output:", out)
+	}
+}
+
+func TestAppendCompress(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		bytes.Repeat([]byte("append compress "), 1000),
+		random,
+	}
+
+	for _, in := range inputs {
+		for level := 0; level <= 9; level += 3 {
+			dst := make([]byte, 3, 3+CompressBound(len(in)))
+			copy(dst, "pre")
+			var out []byte
+			if level == 0 {
+				out = AppendCompress1X(dst, in)
+			} else {
+				out = AppendCompress1X999Level(dst, in, level)
+			}
+			if &out[0] != &dst[0] {
+				t.Error("output buffer reallocated, level", level, len(in))
+			}
+			if string(out[:3]) != "pre" {
+				t.Error("prefix overwritten")
+			}
+			in2, err := AppendDecompress1X(nil, out[3:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(in, in2) {
+				t.Error("data doesn't match, level", level, len(in))
+			}
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+	var dict []byte
+	for i := 0; i < 100; i++ {
+		dict = append(dict, fmt.Sprintf(`{"id":%d,"name":"user%d","active":true}`, i, i*7)...)
+	}
+	in := []byte(`{"id":1000,"name":"user7000","active":false}`)
+
+	cmp999, err := Compress1X999LevelDict(in, dict, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compress1X999LevelDict(in, dict, 0); !errors.Is(err, InvalidLevel) {
+		t.Error("invalid level error expected, found:", err)
+	}
+	for name, cmp := range map[string][]byte{
+		"Compress1XDict":         Compress1XDict(in, dict),
+		"Compress1X999LevelDict": cmp999,
+	} {
+		if len(cmp) >= len(Compress1X999(in)) {
+			t.Errorf("%s: dictionary not used: %d bytes", name, len(cmp))
+		}
+		for _, r := range []io.Reader{bytes.NewReader(cmp), bufio.NewReader(bytes.NewReader(cmp))} {
+			out, err := Decompress1XDict(r, 0, 0, dict)
+			if err != nil || !bytes.Equal(in, out) {
+				t.Errorf("%s: invalid data: %q, %v", name, out, err)
+			}
+		}
+		if _, err := Decompress1X(bytes.NewReader(cmp), 0, 0); !errors.Is(err, LookBehindOverrun) {
+			t.Errorf("%s: lookbehind overrun expected without dictionary, found: %v", name, err)
+		}
+
+		d := NewDecompressor(bytes.NewReader(cmp))
+		d.SetDict(dict)
+		out, err := d.AppendDecompress([]byte(">"), 0)
+		if err != nil || string(out[:1]) != ">" || !bytes.Equal(out[1:], in) {
+			t.Errorf("%s: invalid appended data: %q, %v", name, out, err)
+		}
+	}
+
+	// Larger inputs and dictionaries, of which only the end can be referenced
+	data := readerTestData()
+	for _, n := range []int{1000, 100000} {
+		dict, in := data[:200000], data[200000-n/2:200000+n/2]
+		cmp999, _ := Compress1X999LevelDict(in, dict, 5)
+		for _, cmp := range [][]byte{Compress1XDict(in, dict), cmp999} {
+			out, err := Decompress1XDict(bytes.NewReader(cmp), len(cmp), n, dict)
+			if err != nil || !bytes.Equal(in, out) {
+				t.Errorf("%d bytes: data doesn't match: %v", n, err)
+			}
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	data := readerTestData()[:100000]
+	for level := Level(1); level <= BestCompression; level++ {
+		p, err := level.Params()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmp, err := Compress1X999Params(data, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cmp, Compress1X999Level(data, int(level))) {
+			t.Errorf("level %d: output doesn't match its parameters", level)
+		}
+	}
+
+	p := Params{TryLazy: 1, NiceLen: 64, MaxChain: 64, BestOff: true}
+	cmp, err := Compress1X999Params(data, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data2, err := AppendDecompress1X(nil, cmp); err != nil || !bytes.Equal(data, data2) {
+		t.Error("data doesn't match with custom parameters:", err)
+	}
+	for _, p := range []Params{{GoodLen: -1}, {NiceLen: cSWD_F + 1}, {MaxChain: -1}} {
+		if _, err := Compress1X999Params(data, p); err == nil {
+			t.Errorf("invalid parameters accepted: %+v", p)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	for _, level := range []Level{BestSpeed, 5, BestCompression} {
+		cmp, err := CompressLevel([]byte("level level level level level"), level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := AppendDecompress1X(nil, cmp); err != nil || string(out) != "level level level level level" {
+			t.Errorf("level %d: invalid data: %q, %v", level, out, err)
+		}
+	}
+	for _, level := range []Level{-1, 10} {
+		if _, err := CompressLevel(nil, level); !errors.Is(err, InvalidLevel) {
+			t.Errorf("level %d: invalid level error expected, found: %v", level, err)
+		}
+		if _, err := NewWriter(io.Discard, level); !errors.Is(err, InvalidLevel) {
+			t.Errorf("level %d: invalid level error expected from NewWriter, found: %v", level, err)
+		}
+		if _, err := NewLzopWriterLevel(io.Discard, level); !errors.Is(err, InvalidLevel) {
+			t.Errorf("level %d: invalid level error expected from NewLzopWriterLevel, found: %v", level, err)
+		}
+		if _, err := NewHadoopWriterLevel(io.Discard, level); !errors.Is(err, InvalidLevel) {
+			t.Errorf("level %d: invalid level error expected from NewHadoopWriterLevel, found: %v", level, err)
+		}
+	}
+	cmp, _ := CompressLevel(readerTestData()[:50000], 5)
+	if !bytes.Equal(cmp, Compress1X999Level(readerTestData()[:50000], 5)) {
+		t.Error("output doesn't match Compress1X999Level")
+	}
+	if _, err := BestSpeed.Params(); !errors.Is(err, InvalidLevel) {
+		t.Error("LZO1X-1 has no LZO1X-999 parameters")
+	}
+}
+
+func TestStats(t *testing.T) {
+	data := readerTestData()[:200000]
+
+	cmp, st := Compress1XStats(data)
+	if !bytes.Equal(cmp, Compress1X(data)) {
+		t.Error("output doesn't match Compress1X")
+	}
+	if st.MatchBytes+st.LiteralBytes != len(data) {
+		t.Errorf("LZO1X-1 stats don't cover the input: %+v", st)
+	}
+	if st.M1aMatches != 0 || st.M1bMatches != 0 || st.LazyMatches != 0 || st.M2Matches == 0 || st.M4Matches == 0 || st.ShortRuns == 0 {
+		t.Errorf("unexpected LZO1X-1 stats: %+v", st)
+	}
+
+	cmp, st, err := Compress1X999LevelStats(data, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cmp, Compress1X999(data)) {
+		t.Error("output doesn't match Compress1X999")
+	}
+	if st.MatchBytes+st.LiteralBytes != len(data) {
+		t.Errorf("LZO1X-999 stats don't cover the input: %+v", st)
+	}
+	if st.M1aMatches == 0 || st.M2Matches == 0 || st.M4Matches == 0 || st.LazyMatches == 0 {
+		t.Errorf("unexpected LZO1X-999 stats: %+v", st)
+	}
+	if _, _, err := Compress1X999LevelStats(data, 10); !errors.Is(err, InvalidLevel) {
+		t.Error("invalid level error expected, found:", err)
+	}
+}
+
+func TestVariants(t *testing.T) {
+	data := readerTestData()[:200000]
+
+	// Records with a fixed stride, so that LZO1Z repeats match offsets
+	rnd := rand.New(rand.NewSource(1))
+	var records []byte
+	for i := 0; i < 2000; i++ {
+		records = append(records, byte(rnd.Intn(256)), 'a', 'b', 'c', 'd', 'e', byte(rnd.Intn(256)), 'f', 'g', 'h', 'i', 'j')
+	}
+
+	for _, v := range []struct {
+		name       string
+		cmpfunc    func([]byte) []byte
+		cmp999     func([]byte, Level) ([]byte, error)
+		decompfunc func(io.Reader, int, int) ([]byte, error)
+	}{
+		{"LZO1Y", Compress1Y, Compress1Y999Level, Decompress1Y},
+		{"LZO1Z", Compress1Z, Compress1Z999Level, Decompress1Z},
+	} {
+		for _, in := range [][]byte{nil, data[:10], data[:5000], data, records} {
+			cmps := [][]byte{v.cmpfunc(in)}
+			for _, level := range []Level{1, 9} {
+				cmp, err := v.cmp999(in, level)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cmps = append(cmps, cmp)
+			}
+			for _, cmp := range cmps {
+				out, err := v.decompfunc(bytes.NewReader(cmp), len(cmp), len(in))
+				if err != nil || !bytes.Equal(out, in) {
+					t.Error(v.name, "roundtrip failed, size", len(in), err)
+				}
+				out, err = v.decompfunc(bufio.NewReader(bytes.NewReader(cmp)), 0, len(in))
+				if err != nil || !bytes.Equal(out, in) {
+					t.Error(v.name, "roundtrip failed with bufio, size", len(in), err)
+				}
+			}
+		}
+		if cmp := v.cmpfunc(data); bytes.Equal(cmp, Compress1X(data)) {
+			t.Error(v.name, "output matches LZO1X")
+		}
+		if _, err := v.cmp999(data, 0); !errors.Is(err, InvalidLevel) {
+			t.Error(v.name, "invalid level error expected, found:", err)
+		}
+	}
+
+	// LZO1Y: M2 match of 14 bytes at distance 8
+	in := []byte{17 + 8, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 0xfc, 0x01, m4_MARKER | 1, 0, 0}
+	out, err := Decompress1Y(bytes.NewReader(in), len(in), 0)
+	if err != nil || string(out) != "abcdefghabcdefghabcdef" {
+		t.Errorf("LZO1Y: unexpected output %q, error %v", out, err)
+	}
+
+	// LZO1Z: M2 match of 3 bytes at distance 4, then one of 4 bytes
+	// repeating the distance
+	in = []byte{17 + 4, 'a', 'b', 'c', 'd', 0x40, 0x0c, 0x7c, m4_MARKER | 1, 0, 0}
+	out, err = Decompress1Z(bytes.NewReader(in), len(in), 0)
+	if err != nil || string(out) != "abcdabcdabc" {
+		t.Errorf("LZO1Z: unexpected output %q, error %v", out, err)
+	}
+	in = []byte{17 + 4, 'a', 'b', 'c', 'd', 0x7c, m4_MARKER | 1, 0, 0}
+	if _, err := Decompress1Z(bytes.NewReader(in), len(in), 0); !errors.Is(err, LookBehindOverrun) {
+		t.Error("LZO1Z: expected LookBehindOverrun for a repeated distance at the start, found", err)
+	}
+}
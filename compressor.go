@@ -0,0 +1,135 @@
+package lzo
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// Compressor1X compresses data with LZO1X-1, like Compress1X, but reuses
+// its hash table across calls, which avoids an allocation and the cost of
+// clearing the table for every input. This matters when compressing many
+// small buffers.
+//
+// The zero value is ready to use, with a hash table of 16K entries (64 KiB).
+// A Compressor1X must not be used concurrently, but it can be kept in a
+// sync.Pool.
+type Compressor1X struct {
+	dict []int32
+	base int
+	bits int // log2 of the hash table size, or 0 for the default
+}
+
+// NewCompressor1X creates a new Compressor1X with a hash table of 1<<bits
+// entries, with bits between 11 and 15. This selects one of the variants of
+// liblzo: LZO1X-1(11), LZO1X-1(12), LZO1X-1 (with 14 bits, the default) or
+// LZO1X-1(15). A smaller table uses less memory, while a larger one finds
+// more matches. The output can be
+// decompressed with Decompress1X regardless of the variant.
+func NewCompressor1X(bits int) (*Compressor1X, error) {
+	if bits < d_MIN_BITS || bits > d_MAX_BITS {
+		return nil, fmt.Errorf("lzo: invalid hash table size: %d bits", bits)
+	}
+	return &Compressor1X{bits: bits}, nil
+}
+
+// Reset discards the state of the compressor, clearing its hash table.
+func (c *Compressor1X) Reset() {
+	for i := range c.dict {
+		c.dict[i] = 0
+	}
+	c.base = 0
+}
+
+// Compress compresses in with LZO1X-1.
+func (c *Compressor1X) Compress(in []byte) []byte {
+	return c.appendCompress(nil, in, false)
+}
+
+// AppendCompress compresses src with LZO1X-1, appending the result to dst,
+// like AppendCompress1X.
+func (c *Compressor1X) AppendCompress(dst, src []byte) []byte {
+	return c.appendCompress(dst, src, false)
+}
+
+func (c *Compressor1X) appendCompress(dst, src []byte, rle bool) []byte {
+	// Instead of clearing the table, positions are offset so that entries
+	// of the previous inputs are recognized as stale.
+	if c.dict == nil || c.base > math.MaxInt32-len(src)-1 {
+		bits := c.bits
+		if bits == 0 {
+			bits = d_BITS
+		}
+		c.dict = make([]int32, 1<<bits)
+		c.base = 0
+	}
+	base := c.base
+	c.base += len(src) + 1
+	return compress1X(dst, src, 0, c.dict, base, lzo1x, rle, nil)
+}
+
+// Compressor999 compresses data with LZO1X-999, like Compress1X999Level,
+// but reuses its internal state (a few hundred KiB) across calls. After a
+// small input, only the touched parts of the state are cleared for the
+// next call.
+//
+// A Compressor999 must not be used concurrently, but it can be kept in a
+// sync.Pool.
+type Compressor999 struct {
+	level    Level
+	swd      *swd
+	progress func(consumed, produced int)
+}
+
+// NewCompressor999 creates a new Compressor999 with the specified
+// compression level, between 1 and 9.
+func NewCompressor999(level Level) (*Compressor999, error) {
+	if err := level.check(1); err != nil {
+		return nil, err
+	}
+	return &Compressor999{level: level, swd: newSwd()}, nil
+}
+
+// Reset discards the state of the compressor, bringing it back to the
+// state returned by NewCompressor999.
+func (c *Compressor999) Reset() {
+	*c.swd = swd{used: -1}
+}
+
+// Compress compresses in with LZO1X-999.
+func (c *Compressor999) Compress(in []byte) []byte {
+	return c.AppendCompress(make([]byte, 0, len(in)/2), in)
+}
+
+// AppendCompress compresses src with LZO1X-999, appending the result to
+// dst, like AppendCompress1X999Level.
+func (c *Compressor999) AppendCompress(dst, src []byte) []byte {
+	return compress999(c.swd, dst, src, nil, lzo1x, fixedLevels[c.level-1], nil)
+}
+
+// SetProgress sets a function that CompressContext calls periodically
+// (every KiB of input) with the number of bytes of input consumed and of
+// output produced so far, like lzo_callback_t in liblzo. It is called a
+// last time when the compression completes.
+func (c *Compressor999) SetProgress(progress func(consumed, produced int)) {
+	c.progress = progress
+}
+
+// CompressContext is like Compress, but checks periodically whether the
+// context is canceled, in which case it stops early and returns ctx.Err().
+func (c *Compressor999) CompressContext(ctx context.Context, in []byte) ([]byte, error) {
+	h := hooks{progress: func(consumed, produced int) error {
+		if c.progress != nil {
+			c.progress(consumed, produced)
+		}
+		return ctx.Err()
+	}}
+	out := compress999(c.swd, make([]byte, 0, len(in)/2), in, nil, lzo1x, fixedLevels[c.level-1], &h)
+	if h.err != nil {
+		return nil, h.err
+	}
+	if c.progress != nil {
+		c.progress(len(in), len(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package lzo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Inputs of various sizes, including some larger than the LZO1X-999 window,
+// to check that a reused compressor doesn't see data of previous inputs.
+func compressorTestInputs() [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	var inputs [][]byte
+	for _, n := range []int{100, 5000, 0, 1, 70000, 300, 200000, 17, 4000} {
+		in := make([]byte, n)
+		for i := range in {
+			in[i] = byte('a' + rnd.Intn(3))
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs
+}
+
+func TestCompressor1X(t *testing.T) {
+	var c Compressor1X
+	for _, in := range compressorTestInputs() {
+		if !bytes.Equal(c.Compress(in), Compress1X(in)) {
+			t.Error("output of reused compressor doesn't match, size", len(in))
+		}
+	}
+
+	// Force the positions to wrap around
+	c.base = 1<<31 - 1000
+	in := bytes.Repeat([]byte("wraparound"), 1000)
+	if !bytes.Equal(c.Compress(in), Compress1X(in)) {
+		t.Error("output doesn't match after wrap around")
+	}
+	c.Reset()
+	if !bytes.Equal(c.Compress(in), Compress1X(in)) {
+		t.Error("output doesn't match after Reset")
+	}
+}
+
+func TestCompressor1XBits(t *testing.T) {
+	for bits, cmpfunc := range map[int]func([]byte) []byte{
+		11: Compress1X11,
+		12: Compress1X12,
+		14: Compress1X,
+		15: Compress1X15,
+	} {
+		c, err := NewCompressor1X(bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, in := range compressorTestInputs() {
+			cmp := c.Compress(in)
+			if !bytes.Equal(cmp, cmpfunc(in)) {
+				t.Error("output of reused compressor doesn't match, size", len(in), "bits", bits)
+			}
+			out, err := Decompress1X(bytes.NewReader(cmp), len(cmp), len(in))
+			if err != nil || !bytes.Equal(out, in) {
+				t.Error("roundtrip failed, size", len(in), "bits", bits, err)
+			}
+		}
+	}
+
+	for _, bits := range []int{0, 10, 16} {
+		if _, err := NewCompressor1X(bits); err == nil {
+			t.Error("error expected for invalid size", bits)
+		}
+	}
+}
+
+func TestCompressor999(t *testing.T) {
+	for _, level := range []Level{1, 9} {
+		c, err := NewCompressor999(level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, in := range compressorTestInputs() {
+			if !bytes.Equal(c.Compress(in), Compress1X999Level(in, int(level))) {
+				t.Error("output of reused compressor doesn't match, size", len(in), "level", level)
+			}
+		}
+		c.Reset()
+		in := []byte("after reset, after reset")
+		if !bytes.Equal(c.Compress(in), Compress1X999Level(in, int(level))) {
+			t.Error("output doesn't match after Reset")
+		}
+	}
+
+	if _, err := NewCompressor999(10); err == nil {
+		t.Error("error expected for invalid level")
+	}
+}
+
+func TestCompressContext(t *testing.T) {
+	data := readerTestData()[:100000]
+	c, err := NewCompressor999(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls, last int
+	c.SetProgress(func(consumed, produced int) {
+		if consumed < last || consumed > len(data) {
+			t.Fatalf("invalid progress: %d after %d", consumed, last)
+		}
+		last = consumed
+		calls++
+	})
+	out, err := c.CompressContext(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, Compress1X999(data)) {
+		t.Error("output doesn't match Compress1X999")
+	}
+	if last != len(data) || calls < len(data)/1024 {
+		t.Errorf("progress not reported: %d calls, last at %d", calls, last)
+	}
+
+	// Cancel halfway
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SetProgress(func(consumed, produced int) {
+		last = consumed
+		if consumed > len(data)/2 {
+			cancel()
+		}
+	})
+	if _, err := c.CompressContext(ctx, data); err != context.Canceled {
+		t.Error("cancellation expected, found:", err)
+	}
+	if last > len(data)/2+2048 {
+		t.Error("compression not stopped:", last)
+	}
+	c.SetProgress(nil)
+	if out, err := c.CompressContext(context.Background(), data[:5000]); err != nil || !bytes.Equal(out, Compress1X999(data[:5000])) {
+		t.Error("output doesn't match after cancellation:", err)
+	}
+
+	if _, err := Compress1X999Context(ctx, data, 9); err != context.Canceled {
+		t.Error("cancellation expected, found:", err)
+	}
+	if _, err := Compress1X999Context(ctx, data, 0); !errors.Is(err, InvalidLevel) {
+		t.Error("invalid level error expected, found:", err)
+	}
+}
+
+func BenchmarkCompressor999Small(b *testing.B) {
+	in := bytes.Repeat([]byte("small message "), 20)
+	c, _ := NewCompressor999(5)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Compress(in)
+	}
+}
+
+func BenchmarkCompress999Small(b *testing.B) {
+	in := bytes.Repeat([]byte("small message "), 20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Compress1X999Level(in, 5)
+	}
+}
@@ -1,135 +1,364 @@
 package lzo
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"runtime"
-	"strings"
 )
 
+// Errors returned by the decompressors, matching the error codes of liblzo.
+// InputOverrun and EOFNotFound mean that the input is truncated, while
+// LookBehindOverrun means that it is corrupted.
 var (
-	InputUnderrun      = errors.New("input underrun")
-	LookBehindUnderrun = errors.New("lookbehind underrun")
+	// The input ended in the middle of an instruction.
+	InputOverrun = errors.New("input overrun")
+	// The decompressed data doesn't fit in the output buffer.
+	OutputOverrun = errors.New("output overrun")
+	// A match references data before the beginning of the output.
+	LookBehindOverrun = errors.New("lookbehind overrun")
+	// The input ended between two instructions, without the terminator.
+	EOFNotFound = errors.New("EOF marker not found")
+	// The terminator was found before the end of the input.
+	InputNotConsumed = errors.New("input not consumed")
+	// The decompressed data is shorter than required by an exact Limit.
+	OutputUnderrun = errors.New("output underrun")
+
+	// Former names of InputOverrun and LookBehindOverrun
+	InputUnderrun      = InputOverrun
+	LookBehindUnderrun = LookBehindOverrun
 )
 
+// DecompressError is the error returned by the decompressors when the input
+// is truncated or corrupted, or cannot be read. Together with it, they
+// always return the data that was decompressed up to the failing
+// instruction, so that it can be salvaged.
+type DecompressError struct {
+	Err       error // InputOverrun, LookBehindOverrun, etc., or a read error
+	InOffset  int64 // offset in the compressed input of the failing instruction
+	OutOffset int64 // number of bytes decompressed before the error
+	Opcode    byte  // first byte of the failing instruction
+}
+
+func (e *DecompressError) Error() string {
+	return fmt.Sprintf("lzo: %v at input offset %d (opcode 0x%02x), output offset %d",
+		e.Err, e.InOffset, e.Opcode, e.OutOffset)
+}
+
+func (e *DecompressError) Unwrap() error {
+	return e.Err
+}
+
+// Limit bounds the size of the decompressed data, to defend against
+// malicious streams that expand to huge sizes. The decompressors abort with
+// OutputOverrun as soon as an instruction would exceed Max bytes, and fail
+// with InvalidLimit if Max is negative.
+type Limit struct {
+	Max   int64 // maximum size of the decompressed data; 0 means unlimited
+	Exact bool  // also fail with OutputUnderrun if the data is shorter than Max
+}
+
+// InvalidLimit is the error returned for a Limit with a negative Max.
+var InvalidLimit = errors.New("invalid limit")
+
+func (l Limit) check() error {
+	if l.Max < 0 {
+		return fmt.Errorf("lzo: %w: %d", InvalidLimit, l.Max)
+	}
+	return nil
+}
+
+// Absolute limit for the length of a buffer holding base bytes before the
+// decompressed data, or -1 if unlimited.
+func (l Limit) bound(base int) int {
+	if l.Max <= 0 && !l.Exact {
+		return -1
+	}
+	if l.Max > int64(maxInt-base) {
+		return maxInt
+	}
+	return base + int(l.Max)
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// Size of the buffer of the decoders, and the interval between the checks
+// of the context.
+const rbufSize = 4096
+
 type reader struct {
-	r   io.Reader
-	len int
-	buf [4096]byte
-	cur []byte
-	Err error
+	r     io.Reader
+	len   int  // bytes left to read from r, or -1 if unknown
+	known bool // the length of the input is known
+	buf   []byte
+	cur   []byte
+	Err   error
+	read  int64 // bytes read from r
+
+	// If set, the input is decoded directly from the buffer of r, which is
+	// only advanced past the bytes consumed; peeked is the length of the
+	// data returned by the last peek.
+	pk     peeker
+	peeked int
+
+	// First byte of the instruction being decoded, and bytes read since its
+	// start, so that it is at offset read-opLeft
+	opLeft int
+	opcode byte
+
+	ctx context.Context // checked for cancellation before each read, if set
 }
 
-func newReader(r io.Reader, inlen int) *reader {
+// Prepare to read a new stream of inlen bytes (or unknown length, if inlen
+// is zero) from r, discarding any buffered data. If pk is not nil, it is
+// the peeker for r, and the input is decoded from its buffer.
+func (in *reader) reset(r io.Reader, pk peeker, inlen int) {
+	in.known = inlen > 0
 	if inlen == 0 {
 		inlen = -1
 	}
-	in := &reader{r: r, len: inlen}
+	in.r = r
+	in.len = inlen
+	in.cur = nil
+	in.Err = nil
+	in.read = 0
+	in.pk, in.peeked = pk, 0
 	in.Rebuffer()
-	return in
 }
 
+// Release the buffer of the peeker, advancing it past the bytes consumed.
+func (in *reader) release() {
+	if in.pk != nil {
+		in.pk.discard(in.peeked - len(in.cur))
+		in.cur, in.peeked = nil, 0
+	}
+}
+
+const rbufWnd = 32
+
 // Read more data from the underlying reader and put it into the buffer.
-// Also makes sure there is always at least 32 bytes in the buffer, so that
-// in the main loop we can avoid checking for the end of buffer.
+// Also makes sure there are always more than 32 bytes in the buffer, unless
+// the input is finished, so that the decoder rarely needs to refill it.
 func (in *reader) Rebuffer() {
-	const RBUF_WND = 32
-	var rbuf [RBUF_WND]byte
+	var rbuf [rbufWnd]byte
 
-	if len(in.cur) > RBUF_WND || in.len == 0 {
+	if len(in.cur) > rbufWnd || in.len == 0 {
+		return
+	}
+	if in.pk != nil {
+		in.repeek()
 		return
 	}
+	if in.buf == nil {
+		in.buf = make([]byte, rbufSize)
+	}
 
 	rb := rbuf[:len(in.cur)]
 	copy(rb, in.cur)
-	in.cur = in.buf[:]
+	in.cur = in.buf[:len(rb)]
 	copy(in.cur, rb)
 
-	cur := in.cur[len(rb):]
-	if in.len >= 0 && len(cur) > in.len {
-		cur = cur[:in.len]
+	for len(in.cur) <= rbufWnd && in.len != 0 {
+		if in.ctx != nil {
+			if err := in.ctx.Err(); err != nil {
+				in.len = 0
+				in.Err = err
+				return
+			}
+		}
+		cur := in.buf[len(in.cur):]
+		if in.len >= 0 && len(cur) > in.len {
+			cur = cur[:in.len]
+		}
+		n, err := in.r.Read(cur)
+		in.cur = in.buf[:len(in.cur)+n]
+		in.read += int64(n)
+		in.opLeft += n
+		if in.len >= 0 {
+			in.len -= n
+		}
+		if err != nil {
+			// Stop reading, but keep the bytes in the window, as they
+			// could contain the terminator. If more bytes are needed, the
+			// decoder reports an error.
+			in.len = 0
+			if err != io.EOF {
+				in.Err = err
+			}
+		}
 	}
-	n, err := in.r.Read(cur)
-	if err != nil {
-		// If EOF is returned, treat it as error only if there are no further
-		// bytes in the window. Otherwise, let's postpone because those bytes
-		// could contain the terminator.
-		if err != io.EOF || len(rb) == 0 {
+}
+
+// Rebuffer for a peeker: discard the bytes consumed, and peek at what
+// follows them.
+func (in *reader) repeek() {
+	if in.ctx != nil {
+		if err := in.ctx.Err(); err != nil {
+			in.len = 0
 			in.Err = err
-			in.cur = nil
+			return
 		}
 	}
-	in.cur = in.cur[:len(rb)+n]
+	in.pk.discard(in.peeked - len(in.cur))
+	n, max := rbufWnd+1, -1
 	if in.len >= 0 {
-		in.len -= n
+		// Bytes left in the input, including the unread ones in the window
+		max = in.len + len(in.cur)
+		if n > max {
+			n = max
+		}
+	}
+	b, err := in.pk.peek(n)
+	if max >= 0 && len(b) > max {
+		b = b[:max]
+	}
+	in.read += int64(len(b) - len(in.cur))
+	in.opLeft += len(b) - len(in.cur)
+	if max >= 0 {
+		in.len = max - len(b)
+	}
+	in.cur, in.peeked = b, len(b)
+	if len(b) < n {
+		in.len = 0
+		if err != nil && err != io.EOF {
+			in.Err = err
+		}
+	}
+}
+
+// A peeker gives access to the buffer of a reader, like bufio.Reader does
+// with Peek and Discard.
+type peeker interface {
+	// Return the buffered data, reading more if less than n bytes are
+	// buffered; the error tells why the data is shorter than n.
+	peek(n int) ([]byte, error)
+	discard(n int)
+}
+
+type bufioPeeker struct{ r *bufio.Reader }
+
+func (p bufioPeeker) peek(n int) ([]byte, error) {
+	if p.r.Buffered() < n {
+		if b, err := p.r.Peek(n); err != nil {
+			return b, err
+		}
+	}
+	return p.r.Peek(p.r.Buffered())
+}
+
+func (p bufioPeeker) discard(n int) { p.r.Discard(n) }
+
+type bufferPeeker struct{ b *bytes.Buffer }
+
+func (p bufferPeeker) peek(n int) ([]byte, error) {
+	if p.b.Len() < n {
+		return p.b.Bytes(), io.EOF
+	}
+	return p.b.Bytes(), nil
+}
+
+func (p bufferPeeker) discard(n int) { p.b.Next(n) }
+
+// Return a peeker for r, if it has a buffer that the decoder can use.
+func peekerFor(r io.Reader) peeker {
+	switch r := r.(type) {
+	case *bufio.Reader:
+		if r.Size() > rbufWnd {
+			return bufioPeeker{r}
+		}
+	case *bytes.Buffer:
+		return bufferPeeker{r}
+	}
+	return nil
+}
+
+// Make sure that at least n bytes are buffered, if the input has them.
+func (in *reader) need(n int) bool {
+	in.Rebuffer()
+	return len(in.cur) >= n
+}
+
+// Store ip, the unread part of the buffer, back in the reader, and refill
+// it so that at least n bytes are buffered, if the input has them. Returns
+// the new unread part.
+func (in *reader) more(ip []byte, n int) []byte {
+	in.cur = ip
+	in.need(n)
+	return in.cur
+}
+
+// Offset in the input of the next buffered byte.
+func (in *reader) offset() int64 {
+	return in.read - int64(len(in.cur))
+}
+
+// Append n literals to out, which must not grow past end. If the input is
+// truncated, nothing is appended, like in the other decoders.
+func (in *reader) readLiterals(out []byte, n, end int) ([]byte, error) {
+	if n > end-len(out) {
+		return out, OutputOverrun
+	}
+	if n >= len(in.cur)-rbufWnd {
+		return in.readLiteralsSlow(out, n)
 	}
+	out = append(out, in.cur[:n]...)
+	in.cur = in.cur[n:]
+	return out, nil
 }
 
-func (in *reader) ReadAppend(out *[]byte, n int) {
-	for n > 0 {
+// Slow path of readLiterals, which refills the buffer.
+func (in *reader) readLiteralsSlow(out []byte, n int) ([]byte, error) {
+	start := len(out)
+	for {
 		m := len(in.cur)
 		if m > n {
 			m = n
 		}
-		*out = append(*out, in.cur[:m]...)
+		out = append(out, in.cur[:m]...)
 		in.cur = in.cur[m:]
 		n -= m
-		if len(in.cur) == 0 {
+		if len(in.cur) <= rbufWnd {
 			in.Rebuffer()
-			if len(in.cur) == 0 {
-				in.Err = io.EOF
-				return
-			}
+		}
+		if n == 0 {
+			return out, nil
+		}
+		if len(in.cur) == 0 && !in.need(1) {
+			return out[:start], InputOverrun
 		}
 	}
-	return
-}
-
-func (in *reader) ReadU8() (ch byte) {
-	ch = in.cur[0]
-	in.cur = in.cur[1:]
-	return
 }
 
-func (in *reader) ReadU16() int {
-	b0 := in.cur[0]
-	b1 := in.cur[1]
-	in.cur = in.cur[2:]
-	return int(b0) + int(b1)<<8
-}
-
-func (in *reader) ReadMulti(base int) (b int) {
+// Read a length coded as a sequence of zero bytes, each adding 255, and a
+// final byte, added to base.
+func (in *reader) readMulti(base int) (int, bool) {
+	b := 0
 	for {
-		for i := 0; i < len(in.cur); i++ {
-			v := in.cur[i]
-			if v == 0 {
-				b += 255
-			} else {
-				b += int(v) + base
+		for i, v := range in.cur {
+			if v != 0 {
 				in.cur = in.cur[i+1:]
-				return
+				return b + int(v) + base, true
 			}
+			b += 255
 		}
-		in.cur = in.cur[0:0]
-		in.Rebuffer()
-		if len(in.cur) == 0 {
-			in.Err = io.EOF
-			return
+		in.cur = in.cur[len(in.cur):]
+		if !in.need(1) {
+			return 0, false
 		}
 	}
 }
 
-func copyMatch(out *[]byte, m_pos int, n int) {
-	if m_pos+n > len(*out) {
-		// fmt.Println("copy match WITH OVERLAP!")
+// Append the n bytes at m_pos in out, which can overlap the appended ones.
+func copyMatch(out []byte, m_pos, n int) []byte {
+	if m_pos+n > len(out) {
 		for i := 0; i < n; i++ {
-			*out = append(*out, (*out)[m_pos])
-			m_pos++
+			out = append(out, out[m_pos+i])
 		}
-	} else {
-		// fmt.Println("copy match:", len(*out), m_pos, m_pos+n)
-		*out = append(*out, (*out)[m_pos:m_pos+n]...)
+		return out
 	}
+	return append(out, out[m_pos:m_pos+n]...)
 }
 
 // Decompress an input compressed with LZO1X.
@@ -140,138 +369,531 @@ func copyMatch(out *[]byte, m_pos int, n int) {
 // If inLen is not zero, it is expected to match the length of the compressed
 // input stream, and it is used to limit reads from the underlying reader; if
 // inLen is smaller than the real stream, the decompression will abort with an
-// error; if inLen is larger than the real stream, or if it is zero, the
-// decompression will succeed but more bytes than necessary might be read
-// from the underlying reader. If the reader returns EOF before the termination
-// marker is found, the decompression aborts and EOF is returned.
+// error, and if more input follows the terminator within inLen bytes,
+// InputNotConsumed is returned (together with the complete output), like
+// liblzo does. If the reader returns EOF before the termination marker is
+// found, the decompression aborts and InputOverrun or EOFNotFound is
+// returned.
+//
+// If the reader implements io.ByteReader (like bufio.Reader and
+// bytes.Reader), it is left positioned right after the terminator.
+// Otherwise, if inLen is zero, more bytes than necessary might be read from
+// it; use a Decompressor to retrieve them and the length of the stream.
+//
+// Errors are returned as *DecompressError, which records where decoding
+// failed and wraps one of the errors above (or the error returned by the
+// reader); the output decoded before the failure is returned as well.
 //
 // outLen is optional; if it's not zero, it is used as a hint to preallocate the
-// output buffer to increase performance of the decompression.
+// output buffer to increase performance of the decompression. It does not
+// limit the size of the output: use Decompress1XLimit for untrusted input.
 func Decompress1X(r io.Reader, inLen int, outLen int) (out []byte, err error) {
-	var t, m_pos int
-	var last2 byte
+	var d Decompressor
+	d.Reset(r)
+	return d.decompress(make([]byte, 0, outLen), inLen, false)
+}
+
+// Decompress1XLimit is like Decompress1X, but aborts with OutputOverrun if
+// the decompressed data would exceed the limit. In exact mode, the output
+// buffer is preallocated with the expected size, up to a bound that depends
+// on inLen.
+func Decompress1XLimit(r io.Reader, inLen int, limit Limit) (out []byte, err error) {
+	var d Decompressor
+	d.Reset(r)
+	d.SetLimit(limit)
+	if limit.Exact && limit.Max >= 0 {
+		out = make([]byte, 0, preallocSize(limit.Max, inLen))
+	}
+	return d.decompress(out, inLen, false)
+}
+
+// Size of the buffer to preallocate for max bytes of output. As max might
+// come from an untrusted header, it is capped to what the input plausibly
+// expands to, or to a fixed size if its length is unknown; the buffer grows
+// past that if needed.
+func preallocSize(max int64, inLen int) int {
+	bound := int64(1 << 20)
+	if inLen > 0 {
+		bound = 16 * int64(inLen)
+	}
+	if max > bound {
+		return int(bound)
+	}
+	return int(max)
+}
+
+// Decompress1XDict decompresses a stream compressed with a preset
+// dictionary, like Compress1XDict or Compress1X999LevelDict do, which must
+// be provided again. It is compatible with lzo1x_decompress_dict_safe from
+// liblzo. The meaning of the other arguments is the same as for
+// Decompress1X.
+func Decompress1XDict(r io.Reader, inLen int, outLen int, dict []byte) (out []byte, err error) {
+	var d Decompressor
+	d.Reset(r)
+	d.SetDict(dict)
+	return d.decompress(make([]byte, 0, len(d.dict)+outLen), inLen, false)
+}
+
+// Decompress1XContext is like Decompress1X, but checks periodically (every
+// few KiB of input) whether the context is canceled, in which case it stops
+// early and returns a DecompressError wrapping ctx.Err().
+func Decompress1XContext(ctx context.Context, r io.Reader, inLen int, outLen int) (out []byte, err error) {
+	var d Decompressor
+	d.Reset(r)
+	d.in.ctx = ctx
+	return d.decompress(make([]byte, 0, outLen), inLen, false)
+}
+
+// Decompress an input compressed with LZO-RLE, the variant of LZO1X used by
+// the Linux kernel, as produced by Compress1XRLE.
+//
+// Like the kernel, it detects the bitstream version header at the start of
+// the stream, so that plain LZO1X streams are accepted as well. The meaning
+// of inLen and outLen is the same as for Decompress1X, except that if inLen
+// is zero, an io.ByteReader other than bufio.Reader, bytes.Buffer and the
+// ones that implement io.Seeker may be read past the terminator.
+func Decompress1XRLE(r io.Reader, inLen int, outLen int) (out []byte, err error) {
+	var d Decompressor
+	d.Reset(r)
+	return d.decompress(make([]byte, 0, outLen), inLen, true)
+}
+
+// Decompress1Y decompresses an input compressed with LZO1Y, like
+// Compress1Y or Compress1Y999Level do. The meaning of the arguments and the
+// errors are the same as for Decompress1X, but if the reader doesn't
+// implement io.ByteReader, the input read past the stream is discarded.
+func Decompress1Y(r io.Reader, inLen int, outLen int) (out []byte, err error) {
+	d := Decompressor{v: lzo1y}
+	d.Reset(r)
+	return d.decompress(make([]byte, 0, outLen), inLen, false)
+}
+
+// Decompress1Z decompresses an input compressed with LZO1Z, like
+// Compress1Z or Compress1Z999Level do, in the same way as Decompress1Y.
+func Decompress1Z(r io.Reader, inLen int, outLen int) (out []byte, err error) {
+	d := Decompressor{v: lzo1z}
+	d.Reset(r)
+	return d.decompress(make([]byte, 0, outLen), inLen, false)
+}
+
+// Decompressor decompresses LZO1X streams, like Decompress1X, but reuses its
+// input buffer and, optionally, its output buffer across calls, so that
+// decoding many streams produces no garbage.
+//
+// The zero value is ready to use after a call to Reset. A Decompressor must
+// not be used concurrently, but it can be kept in a sync.Pool.
+type Decompressor struct {
+	v        variant // format of the streams, LZO1X unless set internally
+	in       reader
+	p        parser
+	out      []byte
+	limit    Limit
+	dict     []byte
+	consumed int64
+}
 
+// NewDecompressor creates a new Decompressor reading from r.
+func NewDecompressor(r io.Reader) *Decompressor {
+	d := new(Decompressor)
+	d.Reset(r)
+	return d
+}
+
+// Reset makes the Decompressor read from r, discarding any buffered input.
+// The output buffer is retained.
+func (d *Decompressor) Reset(r io.Reader) {
+	d.in.r = r
+	d.in.cur = nil
+	d.in.Err = nil
+	d.consumed = 0
+}
+
+// SetLimit sets the limit on the size of the data decompressed by each
+// subsequent call. The zero Limit disables it.
+func (d *Decompressor) SetLimit(l Limit) {
+	d.limit = l
+}
+
+// SetDict sets the preset dictionary that the streams decompressed by each
+// subsequent call were compressed with, like in Decompress1XDict. A nil
+// dictionary disables it.
+func (d *Decompressor) SetDict(dict []byte) {
+	if len(dict) > m4_MAX_OFFSET {
+		dict = dict[len(dict)-m4_MAX_OFFSET:]
+	}
+	d.dict = dict
+}
+
+// Decompress reads a stream from the underlying reader and decompresses it
+// into the Decompressor's output buffer, which is returned. The buffer is
+// overwritten by the next call to Decompress, so the caller must copy the
+// data it needs to retain.
+//
+// The meaning of inLen is the same as for Decompress1X. If the reader
+// implements io.ByteReader, it is left positioned right after the stream
+// terminator, so consecutive streams can be decoded from it even if inLen
+// is zero. Otherwise, the input read past the terminator is returned by
+// Buffered, and discarded by the next call.
+func (d *Decompressor) Decompress(inLen int) ([]byte, error) {
+	out, err := d.decompress(d.out[:0], inLen, false)
+	d.out = out[:0]
+	return out, err
+}
+
+// AppendDecompress is like Decompress, but appends the decompressed data to
+// dst, and returns the extended buffer. Matches cannot reference the data
+// that was already in dst.
+func (d *Decompressor) AppendDecompress(dst []byte, inLen int) ([]byte, error) {
+	return d.decompress(dst, inLen, false)
+}
+
+// Consumed returns the length of the compressed stream decoded by the last
+// call to Decompress or AppendDecompress, including the terminator. If the
+// call failed, it counts the bytes read up to the error.
+func (d *Decompressor) Consumed() int64 {
+	return d.consumed
+}
+
+// Buffered returns the input that the last call to Decompress or
+// AppendDecompress read from the underlying reader past the end of the
+// stream, which is empty if the reader implements io.ByteReader. The slice
+// is only valid until the next call.
+func (d *Decompressor) Buffered() []byte {
+	return d.in.cur
+}
+
+func (d *Decompressor) decompress(dst []byte, inLen int, rle bool) ([]byte, error) {
+	if err := d.limit.check(); err != nil {
+		return dst, err
+	}
+	if len(d.dict) == 0 {
+		return d.decode(dst, 0, inLen, rle)
+	}
+	// Decode after a copy of the dictionary, which is then removed
+	start := len(dst)
+	out, err := d.decode(append(dst, d.dict...), len(d.dict), inLen, rle)
+	n := copy(out[start:], out[start+len(d.dict):])
+	return out[:start+n], err
+}
+
+// Decode a stream appending it to dst, whose last dictLen bytes are the
+// preset dictionary.
+func (d *Decompressor) decode(dst []byte, dictLen int, inLen int, rle bool) ([]byte, error) {
+	br, isByteReader := d.in.r.(byteReader)
+	s, isSeeker := d.in.r.(io.Seeker)
+	if d.v != lzo1x && !isByteReader {
+		// LZO1Y and LZO1Z are only decoded by the parser, through a
+		// buffer that is discarded afterwards
+		r := d.in.r
+		if inLen > 0 {
+			r = io.LimitReader(r, int64(inLen))
+		}
+		br, isByteReader = bufio.NewReader(r), true
+	}
+	pk := peekerFor(d.in.r)
+	if d.v != lzo1x || (isByteReader && !isSeeker && pk == nil && inLen == 0 && !rle) {
+		// The parser reads one byte at a time, so that the stream is not
+		// over-read. Besides LZO1Y and LZO1Z, it is only used for the
+		// ByteReaders that can be neither decoded in place nor sought
+		// back, when the length of the stream is unknown
+		d.in.cur = nil
+		out, err := d.decompressBytes(dst, dictLen, br, inLen)
+		d.consumed = d.p.in
+		return out, err
+	}
+
+	d.in.reset(d.in.r, pk, inLen)
+	out, err := decode1X(&d.in, dst, dictLen, d.limit.bound(len(dst)), d.limit.Exact, rle)
+	d.consumed = d.in.offset()
+	d.in.release()
+	if isByteReader && isSeeker && len(d.in.cur) > 0 {
+		// An in-memory reader (bytes.Reader, etc.): put back what was
+		// over-read, which is cheaper than reading one byte at a time
+		if _, err := s.Seek(-int64(len(d.in.cur)), io.SeekCurrent); err == nil {
+			d.in.cur = nil
+		}
+	}
+	return out, err
+}
+
+// Decompress a stream reading from r through the parser, which never reads
+// past the terminator.
+func (d *Decompressor) decompressBytes(dst []byte, dictLen int, r byteReader, inLen int) (out []byte, err error) {
+	out = dst
+	start := len(out)
+	limit := d.limit.bound(start)
+
+	p := &d.p
+	max := int64(inLen)
+	if inLen == 0 {
+		max = -1
+	}
+	p.reset(r, d.v, max)
+	p.out = int64(dictLen)
 	defer func() {
-		// To gain performance, we don't do any bounds checking while reading
-		// the input, so if the decompressor reads past the end of the input
-		// stream, a runtime error is raised. This saves about 7% of performance
-		// as the reading functions are very hot in the decompressor.
-		if r := recover(); r != nil {
-			if re, ok := r.(runtime.Error); ok {
-				if strings.HasPrefix(re.Error(), "runtime error: index out of range") {
-					err = io.EOF
-					return
+		if err != nil {
+			err = &DecompressError{Err: err, InOffset: p.op, OutOffset: int64(len(out) - start), Opcode: p.opcode}
+		}
+	}()
+
+	var check int64 // input offset of the next check of the context
+	for {
+		if d.in.ctx != nil && p.in >= check {
+			if err = d.in.ctx.Err(); err != nil {
+				p.op, p.opcode = p.in, 0
+				return out, err
+			}
+			check = p.in + rbufSize
+		}
+		if err = p.step(); err != nil {
+			if err != io.EOF {
+				return out, err
+			}
+			if d.limit.Exact && len(out) != limit {
+				return out, OutputUnderrun
+			}
+			if p.trailing() {
+				return out, InputNotConsumed
+			}
+			return out, nil
+		}
+		if limit >= 0 && p.out-int64(dictLen) > int64(limit-start) {
+			return out, OutputOverrun
+		}
+		if p.mlen > 0 {
+			m_pos := len(out) - p.mdist
+			if p.mdist >= p.mlen {
+				out = append(out, out[m_pos:m_pos+p.mlen]...)
+			} else {
+				for i := 0; i < p.mlen; i++ {
+					out = append(out, out[m_pos+i])
 				}
 			}
-			panic(r)
+			p.mlen = 0
 		}
-	}()
+		if p.lit > 0 {
+			n := len(out)
+			if cap(out)-n < p.lit {
+				out = append(out, make([]byte, p.lit)...)
+			}
+			m, err := p.readLiterals(out[n : n+p.lit])
+			if err != nil {
+				return out[:n], err
+			}
+			out = out[:n+m]
+		}
+	}
+}
+
+// Decode the LZO1X stream read from in, appending it to out, whose last
+// dictLen bytes are the preset dictionary. out is never grown past limit, if
+// it is not negative, and must reach it if exact is true. If rle is true,
+// the LZO-RLE extensions are decoded as well.
+func decode1X(in *reader, out []byte, dictLen, limit int, exact, rle bool) ([]byte, error) {
+	start := len(out)
+	end := limit
+	if end < 0 {
+		end = maxInt
+	}
+	out, err := decodeLoop1X(in, out, start-dictLen, end, rle)
+	if err == nil {
+		switch {
+		case in.Err != nil:
+			err = in.Err
+		case exact && len(out) != limit:
+			err = OutputUnderrun
+		case in.known && (len(in.cur) > 0 || in.need(1)):
+			err = InputNotConsumed
+		}
+	}
+	if err != nil {
+		return out, &DecompressError{Err: err, InOffset: in.read - int64(in.opLeft), OutOffset: int64(len(out) - start), Opcode: in.opcode}
+	}
+	return out, nil
+}
 
-	out = make([]byte, 0, outLen)
+// Main loop of decode1X, which returns at the stream terminator. Matches
+// cannot reference data before base, and out cannot grow past end.
+//
+// The hot path is kept as lean as possible: the input buffer is only
+// refilled when it runs low, the offset and the first byte of the
+// instruction being decoded (for error reporting) are kept in the reader,
+// and the other checks are left to decode1X.
+func decodeLoop1X(in *reader, out []byte, base, end int, rle bool) ([]byte, error) {
+	var t, m_pos int
+	var last2, version byte
+	var ok bool
+	var err error
 
-	in := newReader(r, inLen)
-	ip := in.ReadU8()
-	if ip > 17 {
-		t = int(ip) - 17
+	// The unread input is kept in ip, and only stored back in in.cur
+	// around the calls that need it
+	ip := in.cur
+	in.opLeft, in.opcode = len(in.cur), 0
+	if rle {
+		if len(ip) < 2 {
+			ip = in.more(ip, 2)
+		}
+		if len(ip) >= 2 && ip[0] == 17 && ip[1] != 0 {
+			// A plain LZO1X stream starts with 17 only if it is empty, in
+			// which case it is followed by the rest of the terminator.
+			version = ip[1]
+			ip = ip[2:]
+		}
+	}
+	if len(ip) == 0 {
+		if ip = in.more(ip, 1); len(ip) == 0 {
+			goto eof_not_found
+		}
+	}
+	in.opLeft, in.opcode = len(ip), ip[0]
+	ip = ip[1:]
+	t = int(in.opcode)
+	if t > 17 {
+		t -= 17
 		if t < 4 {
 			goto match_next
 		}
-		in.ReadAppend(&out, t)
-		// fmt.Println("begin:", string(out))
+		in.cur = ip
+		out, err = in.readLiterals(out, t, end)
+		ip = in.cur
+		if err != nil {
+			goto fail
+		}
 		goto first_literal_run
 	}
 
 begin_loop:
-	t = int(ip)
 	if t >= 16 {
 		goto match
 	}
+	in.cur = ip
 	if t == 0 {
-		t = in.ReadMulti(15)
+		if t, ok = in.readMulti(15); !ok {
+			goto input_overrun
+		}
+	}
+	out, err = in.readLiterals(out, t+3, end)
+	ip = in.cur
+	if err != nil {
+		goto fail
 	}
-	in.ReadAppend(&out, t+3)
-	// fmt.Println("readappend", t+3, string(out[len(out)-t-3:]))
 first_literal_run:
-	ip = in.ReadU8()
-	last2 = ip
-	t = int(ip)
+	if len(ip) < 2 {
+		if ip = in.more(ip, 2); len(ip) == 0 {
+			goto eof_not_found
+		}
+	}
+	in.opLeft, in.opcode = len(ip), ip[0]
+	t = int(ip[0])
 	if t >= 16 {
+		ip = ip[1:]
 		goto match
 	}
+	if len(ip) < 2 {
+		ip = ip[1:]
+		goto input_overrun
+	}
+	last2 = ip[0]
 	m_pos = len(out) - (1 + m2_MAX_OFFSET)
 	m_pos -= t >> 2
-	ip = in.ReadU8()
-	m_pos -= int(ip) << 2
-	// fmt.Println("m_pos flr", m_pos, len(out), "\n", string(out))
-	if m_pos < 0 {
-		err = LookBehindUnderrun
-		return
-	}
-	copyMatch(&out, m_pos, 3)
-	goto match_done
+	m_pos -= int(ip[1]) << 2
+	ip = ip[2:]
+	t = 1
+	goto copy_match
 
 match:
-	in.Rebuffer()
-	if in.Err != nil {
-		err = in.Err
-		return
+	// t is the opcode, already consumed from the input
+	if len(ip) <= rbufWnd {
+		ip = in.more(ip, rbufWnd+1)
 	}
-	t = int(ip)
-	last2 = ip
+	last2 = in.opcode
 	if t >= 64 {
+		if len(ip) == 0 {
+			goto input_overrun
+		}
 		m_pos = len(out) - 1
 		m_pos -= (t >> 2) & 7
-		ip = in.ReadU8()
-		m_pos -= int(ip) << 3
-		// fmt.Println("m_pos t64", m_pos, t, int(ip))
+		m_pos -= int(ip[0]) << 3
+		ip = ip[1:]
 		t = (t >> 5) - 1
-		goto copy_match
 	} else if t >= 32 {
 		t &= 31
 		if t == 0 {
-			t = in.ReadMulti(31)
+			in.cur = ip
+			t, ok = in.readMulti(31)
+			ip = in.cur
+			if !ok {
+				goto input_overrun
+			}
+			if len(ip) < 2 {
+				ip = in.more(ip, 2)
+			}
+		}
+		if len(ip) < 2 {
+			goto input_overrun
 		}
 		m_pos = len(out) - 1
-		v16 := in.ReadU16()
-		m_pos -= v16 >> 2
-		last2 = byte(v16 & 0xFF)
-		// fmt.Println("m_pos t32", m_pos)
+		m_pos -= (int(ip[0]) + int(ip[1])<<8) >> 2
+		last2 = ip[0]
+		ip = ip[2:]
 	} else if t >= 16 {
+		if version > 0 && t&0xf8 == 0x18 && len(ip) >= 3 && ip[0]&0xfc == 0xfc && ip[1] == 0xff {
+			// LZO-RLE zero run
+			t = (t & 7) | int(ip[2])<<3
+			last2 = ip[0]
+			ip = ip[3:]
+			if t+zr_MIN_LEN > end-len(out) {
+				goto output_overrun
+			}
+			for i := 0; i < t+zr_MIN_LEN; i++ {
+				out = append(out, 0)
+			}
+			goto match_done
+		}
 		m_pos = len(out)
 		m_pos -= (t & 8) << 11
 		t &= 7
 		if t == 0 {
-			t = in.ReadMulti(7)
+			in.cur = ip
+			t, ok = in.readMulti(7)
+			ip = in.cur
+			if !ok {
+				goto input_overrun
+			}
+			if len(ip) < 2 {
+				ip = in.more(ip, 2)
+			}
 		}
-		v16 := in.ReadU16()
-		m_pos -= v16 >> 2
+		if len(ip) < 2 {
+			goto input_overrun
+		}
+		m_pos -= (int(ip[0]) + int(ip[1])<<8) >> 2
+		last2 = ip[0]
+		ip = ip[2:]
 		if m_pos == len(out) {
-			// fmt.Println("END", t, v16, m_pos)
-			return
+			in.cur = ip
+			return out, nil
 		}
 		m_pos -= 0x4000
-		last2 = byte(v16 & 0xFF)
-		// fmt.Println("m_pos t16", m_pos)
 	} else {
+		if len(ip) == 0 {
+			goto input_overrun
+		}
 		m_pos = len(out) - 1
 		m_pos -= t >> 2
-		ip = in.ReadU8()
-		m_pos -= int(ip) << 2
-		if m_pos < 0 {
-			err = LookBehindUnderrun
-			return
-		}
-		// fmt.Println("m_pos tX", m_pos)
-		copyMatch(&out, m_pos, 2)
-		goto match_done
+		m_pos -= int(ip[0]) << 2
+		ip = ip[1:]
+		t = 0
 	}
 
 copy_match:
-	if m_pos < 0 {
-		err = LookBehindUnderrun
-		return
+	if m_pos < base {
+		goto lookbehind_overrun
+	}
+	if t+2 > end-len(out) {
+		goto output_overrun
 	}
-	copyMatch(&out, m_pos, t+2)
+	out = copyMatch(out, m_pos, t+2)
 
 match_done:
 	t = int(last2 & 3)
@@ -279,12 +901,90 @@ match_done:
 		goto match_end
 	}
 match_next:
-	// fmt.Println("read append finale:", t)
-	in.ReadAppend(&out, t)
-	ip = in.ReadU8()
+	in.cur = ip
+	out, err = in.readLiterals(out, t, end)
+	ip = in.cur
+	if err != nil {
+		goto fail
+	}
+	if len(ip) == 0 {
+		if ip = in.more(ip, 1); len(ip) == 0 {
+			goto eof_not_found
+		}
+	}
+	in.opLeft, in.opcode = len(ip), ip[0]
+	ip = ip[1:]
+	t = int(in.opcode)
 	goto match
 
 match_end:
-	ip = in.ReadU8()
+	if len(ip) == 0 {
+		if ip = in.more(ip, 1); len(ip) == 0 {
+			goto eof_not_found
+		}
+	}
+	in.opLeft, in.opcode = len(ip), ip[0]
+	ip = ip[1:]
+	t = int(in.opcode)
 	goto begin_loop
+
+eof_not_found:
+	in.opLeft, in.opcode = len(ip), 0
+	err = EOFNotFound
+	goto fail
+input_overrun:
+	err = InputOverrun
+	goto fail
+output_overrun:
+	err = OutputOverrun
+	goto fail
+lookbehind_overrun:
+	err = LookBehindOverrun
+fail:
+	in.cur = ip
+	if in.Err != nil {
+		// An error returned by the underlying reader takes precedence
+		err = in.Err
+	}
+	return out, err
+}
+
+// Decompress1XInto decompresses the LZO1X stream in src into dst, and returns
+// the number of bytes written. It never allocates; if the decompressed data
+// doesn't fit in dst, OutputOverrun is returned. InputOverrun or EOFNotFound
+// are returned if src ends before the stream terminator, and
+// InputNotConsumed if src continues after it (in which case dst holds the
+// complete decompressed data). As in Decompress1X, errors are returned as
+// *DecompressError, and n counts the bytes decoded before the failure.
+func Decompress1XInto(dst, src []byte) (n int, err error) {
+	out, err := appendDecompress1X(dst[:0], src, len(dst), false)
+	return len(out), err
+}
+
+// AppendDecompress1X decompresses the LZO1X stream in src, appending the
+// result to dst, and returns the extended buffer. Matches cannot reference
+// the data that was already in dst. Errors are reported like in
+// Decompress1XInto.
+func AppendDecompress1X(dst, src []byte) ([]byte, error) {
+	return appendDecompress1X(dst, src, -1, false)
+}
+
+// AppendDecompress1XLimit is like AppendDecompress1X, but aborts with
+// OutputOverrun if the decompressed data would exceed the limit.
+func AppendDecompress1XLimit(dst, src []byte, limit Limit) ([]byte, error) {
+	if err := limit.check(); err != nil {
+		return dst, err
+	}
+	return appendDecompress1X(dst, src, limit.bound(len(dst)), limit.Exact)
+}
+
+// Decode the LZO1X stream in src, appending it to out. Matches cannot
+// reference bytes before the initial length of out; if limit is not
+// negative, out is never grown beyond it, and if exact is true, out must
+// reach it.
+func appendDecompress1X(out, src []byte, limit int, exact bool) ([]byte, error) {
+	// A reader that has already read all of src into its window
+	var in reader
+	in.cur, in.read, in.known = src, int64(len(src)), true
+	return decode1X(&in, out, 0, limit, exact, false)
 }
@@ -1,14 +1,390 @@
 package lzo
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestDecompCrasher1(t *testing.T) {
 	Decompress1X(strings.NewReader("\x00"), 0, 0)
+	AppendDecompress1X(nil, []byte("\x00"))
 }
 
 func TestDecompCrasher2(t *testing.T) {
 	Decompress1X(strings.NewReader("\x00\x030000000000000000000000\x01\x000\x000"), 0, 0)
+	AppendDecompress1X(nil, []byte("\x00\x030000000000000000000000\x01\x000\x000"))
+}
+
+func TestDecompInto(t *testing.T) {
+	data := readerTestData()
+	for _, cmp := range [][]byte{Compress1X(data), Compress1X999(data)} {
+		dst := make([]byte, len(data))
+		n, err := Decompress1XInto(dst, cmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, dst[:n]) {
+			t.Error("data doesn't match")
+		}
+
+		if _, err := Decompress1XInto(dst[:len(data)-1], cmp); !errors.Is(err, OutputOverrun) {
+			t.Error("output overrun expected, found:", err)
+		}
+		if _, err := Decompress1XInto(dst, cmp[:len(cmp)-1]); !errors.Is(err, InputOverrun) {
+			t.Error("input overrun expected, found:", err)
+		}
+	}
+}
+
+func TestAppendDecomp(t *testing.T) {
+	data := bytes.Repeat([]byte("append "), 1000)
+	cmp := Compress1X(data)
+
+	out, err := AppendDecompress1X([]byte("prefix"), cmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out[:6]) != "prefix" || !bytes.Equal(out[6:], data) {
+		t.Error("data doesn't match")
+	}
+
+	dst := make([]byte, 0, len(data))
+	if allocs := testing.AllocsPerRun(10, func() {
+		AppendDecompress1X(dst, cmp)
+	}); allocs != 0 {
+		t.Error("unexpected allocations:", allocs)
+	}
+}
+
+func TestDecompressor(t *testing.T) {
+	msgs := [][]byte{
+		bytes.Repeat([]byte("first message "), 100),
+		[]byte("second"),
+		bytes.Repeat([]byte("third message "), 1000),
+	}
+	var stream []byte
+	var lens []int
+	for _, m := range msgs {
+		cmp := Compress1X(m)
+		stream = append(stream, cmp...)
+		lens = append(lens, len(cmp))
+	}
+
+	d := NewDecompressor(bytes.NewReader(stream))
+	for i, m := range msgs {
+		out, err := d.Decompress(lens[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, m) {
+			t.Error("data doesn't match for message", i)
+		}
+	}
+
+	var br bytes.Reader
+	cmp := stream[:lens[0]]
+	if allocs := testing.AllocsPerRun(10, func() {
+		br.Reset(cmp)
+		d.Reset(&br)
+		d.Decompress(len(cmp))
+	}); allocs != 0 {
+		t.Error("unexpected allocations:", allocs)
+	}
+
+	br.Reset(cmp)
+	d.Reset(&br)
+	out, err := d.AppendDecompress([]byte(">"), 0)
+	if err != nil || string(out[:1]) != ">" || !bytes.Equal(out[1:], msgs[0]) {
+		t.Error("invalid appended data:", err)
+	}
+}
+
+func TestDecompTruncated(t *testing.T) {
+	data := bytes.Repeat([]byte("truncated input, "), 300)
+	for _, cmp := range [][]byte{Compress1X(data), Compress1X999(data)} {
+		for i := 0; i < len(cmp); i++ {
+			_, err := Decompress1X(bytes.NewReader(cmp[:i]), 0, 0)
+			if !errors.Is(err, InputOverrun) && !errors.Is(err, EOFNotFound) {
+				t.Fatalf("truncated input error expected at %d, found: %v", i, err)
+			}
+		}
+
+		// Readers returning data together with EOF, or one byte at a time
+		for _, r := range []io.Reader{
+			iotest.DataErrReader(bytes.NewReader(cmp)),
+			iotest.OneByteReader(bytes.NewReader(cmp)),
+		} {
+			data2, err := Decompress1X(r, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, data2) {
+				t.Error("data doesn't match")
+			}
+		}
+	}
+}
+
+func TestDecompTruncatedLiterals(t *testing.T) {
+	// Incompressible data between matches, for long literal runs
+	var data []byte
+	for i := 0; i < 4; i++ {
+		data = append(data, bytes.Repeat([]byte("literals "), 10)...)
+		for j := 0; j < 300; j++ {
+			data = append(data, byte(j*j*7+i*31+j>>3))
+		}
+	}
+	cmp := Compress1X(data)
+	for i := 0; i < len(cmp); i++ {
+		in := cmp[:i]
+		out, err := AppendDecompress1X(nil, in)
+		want, ok := err.(*DecompressError)
+		if !ok {
+			t.Fatalf("truncated input error expected at %d, found: %v", i, err)
+		}
+		check := func(name string, out []byte, err error) {
+			t.Helper()
+			derr, ok := err.(*DecompressError)
+			if !ok || *derr != *want {
+				t.Fatalf("%s: at %d, %v expected, found: %v", name, i, want, err)
+			}
+			if out != nil && !bytes.Equal(out, data[:want.OutOffset]) {
+				t.Fatalf("%s: at %d, invalid partial data", name, i)
+			}
+		}
+		check("AppendDecompress1X", out, err)
+		for _, inLen := range []int{0, i} {
+			out, err = Decompress1X(iotest.OneByteReader(bytes.NewReader(in)), inLen, 0)
+			check("Decompress1X", out, err)
+			out, err = Decompress1X(bufio.NewReader(bytes.NewReader(in)), inLen, 0)
+			check("Decompress1X bufio", out, err)
+		}
+		_, err = DecompressedSize(in)
+		check("DecompressedSize", nil, err)
+		_, err = Validate(bytes.NewReader(in))
+		check("Validate", nil, err)
+		out, err = ioutil.ReadAll(NewReader(bytes.NewReader(in)))
+		check("Reader", out, err)
+	}
+}
+
+func TestDecompReadError(t *testing.T) {
+	cmp := Compress1X(bytes.Repeat([]byte("read error "), 1000))
+	r := iotest.TimeoutReader(iotest.HalfReader(bytes.NewReader(cmp)))
+	if _, err := Decompress1X(r, 0, 0); !errors.Is(err, iotest.ErrTimeout) {
+		t.Error("read error expected, found:", err)
+	}
+}
+
+func TestDecompContext(t *testing.T) {
+	data := readerTestData()
+	cmp := Compress1X(data)
+	out, err := Decompress1XContext(context.Background(), bytes.NewReader(cmp), 0, 0)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Error("data doesn't match:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range []io.Reader{bytes.NewReader(cmp), bufio.NewReader(bytes.NewReader(cmp))} {
+		if _, err := Decompress1XContext(ctx, r, 0, 0); !errors.Is(err, context.Canceled) {
+			t.Error("cancellation expected, found:", err)
+		}
+	}
+}
+
+func TestDecompErrors(t *testing.T) {
+	cmp := Compress1X(bytes.Repeat([]byte("error codes "), 100))
+	end := len(cmp) - 3 // start of the terminator
+
+	tests := []struct {
+		in  []byte
+		err error
+	}{
+		{cmp, nil},
+		{nil, EOFNotFound},
+		{cmp[:end], EOFNotFound},
+		{cmp[:end+1], InputOverrun},
+		{cmp[:end+2], InputOverrun},
+		{append(cmp[:len(cmp):len(cmp)], 0), InputNotConsumed},
+		// One literal, then a match at distance 16
+		{[]byte{18, 'a', m2_MARKER | 7<<2, 1, m4_MARKER | 1, 0, 0}, LookBehindOverrun},
+	}
+	for i, test := range tests {
+		if _, err := AppendDecompress1X(nil, test.in); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected, found: %v", i, test.err, err)
+		}
+		if _, err := DecompressedSize(test.in); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected from DecompressedSize, found: %v", i, test.err, err)
+		}
+		if _, err := Decompress1X(bytes.NewReader(test.in), len(test.in), 0); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected from Decompress1X, found: %v", i, test.err, err)
+		}
+		br := bufio.NewReader(bytes.NewReader(test.in))
+		if _, err := Decompress1X(br, len(test.in), 0); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected from Decompress1X with a ByteReader, found: %v", i, test.err, err)
+		}
+		if _, err := Decompress1X(bytes.NewBuffer(test.in), len(test.in), 0); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected from Decompress1X with a bytes.Buffer, found: %v", i, test.err, err)
+		}
+		if test.err == InputNotConsumed {
+			// Without the input length, decoding stops at the terminator
+			continue
+		}
+		if _, err := Validate(bytes.NewReader(test.in)); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected from Validate, found: %v", i, test.err, err)
+		}
+		if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(test.in))); !errors.Is(err, test.err) {
+			t.Errorf("test %d: %v expected from Reader, found: %v", i, test.err, err)
+		}
+	}
+}
+
+func TestDecompressError(t *testing.T) {
+	// Five literals, then a match at distance 16
+	in := []byte{17 + 5, 'h', 'e', 'l', 'l', 'o', m2_MARKER | 7<<2, 1, m4_MARKER | 1, 0, 0}
+	check := func(name string, out []byte, err error) {
+		derr, ok := err.(*DecompressError)
+		if !ok {
+			t.Fatalf("%s: DecompressError expected, found: %v", name, err)
+		}
+		if derr.Err != LookBehindOverrun || derr.InOffset != 6 || derr.OutOffset != 5 || derr.Opcode != in[6] {
+			t.Errorf("%s: invalid error: %+v", name, derr)
+		}
+		if string(out) != "hello" {
+			t.Errorf("%s: partial output not returned: %q", name, out)
+		}
+	}
+
+	out, err := AppendDecompress1X(nil, in)
+	check("AppendDecompress1X", out, err)
+	out, err = Decompress1X(bytes.NewReader(in), 0, 0)
+	check("Decompress1X", out, err)
+	out, err = Decompress1X(bufio.NewReader(bytes.NewReader(in)), 0, 0)
+	check("Decompress1X with a ByteReader", out, err)
+	out, err = Decompress1X(bytes.NewBuffer(in), 0, 0)
+	check("Decompress1X with a bytes.Buffer", out, err)
+	out, err = ioutil.ReadAll(NewReader(bytes.NewReader(in)))
+	check("Reader", out, err)
+}
+
+func TestDecompConsumed(t *testing.T) {
+	data := bytes.Repeat([]byte("consumed input "), 1000)
+	cmp := Compress1X(data)
+	trailer := bytes.Repeat([]byte("trailer"), 1000)
+	stream := append(cmp[:len(cmp):len(cmp)], trailer...)
+
+	// The reader is left positioned after the terminator
+	for name, r := range map[string]interface {
+		io.Reader
+		io.ByteReader
+	}{
+		"bufio.Reader": bufio.NewReader(bytes.NewReader(stream)),
+		"bytes.Reader": bytes.NewReader(stream),
+		"bytes.Buffer": bytes.NewBuffer(stream),
+		// Refilled many times, and too small to be decoded in place
+		"bufio.Reader of one-byte reads": bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(stream)), 64),
+		"small bufio.Reader":             bufio.NewReaderSize(bytes.NewReader(stream), 16),
+	} {
+		d := NewDecompressor(r)
+		out, err := d.Decompress(0)
+		if err != nil || !bytes.Equal(out, data) {
+			t.Fatalf("%s: invalid data: %v", name, err)
+		}
+		if d.Consumed() != int64(len(cmp)) {
+			t.Errorf("%s: %d bytes consumed, expected %d", name, d.Consumed(), len(cmp))
+		}
+		if len(d.Buffered()) != 0 {
+			t.Errorf("%s: %d bytes buffered", name, len(d.Buffered()))
+		}
+		if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, trailer) {
+			t.Errorf("%s: reader not positioned after the stream: %d bytes left", name, len(rest))
+		}
+	}
+
+	// The over-read bytes are handed back
+	r := iotest.HalfReader(bytes.NewReader(stream))
+	d := NewDecompressor(r)
+	if _, err := d.Decompress(0); err != nil {
+		t.Fatal(err)
+	}
+	if d.Consumed() != int64(len(cmp)) {
+		t.Errorf("%d bytes consumed, expected %d", d.Consumed(), len(cmp))
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if rest = append(d.Buffered(), rest...); !bytes.Equal(rest, trailer) {
+		t.Error("over-read bytes not returned by Buffered")
+	}
+
+	// Consecutive streams without their length
+	br := bufio.NewReader(bytes.NewReader(append(stream[:len(cmp):len(cmp)], cmp...)))
+	d.Reset(br)
+	for i := 0; i < 2; i++ {
+		if out, err := d.Decompress(0); err != nil || !bytes.Equal(out, data) {
+			t.Fatalf("stream %d: invalid data: %v", i, err)
+		}
+	}
+}
+
+func TestDecompLimit(t *testing.T) {
+	// Four literals, then a match at distance 1 of 255*1000+33 bytes
+	bomb := []byte{17 + 4, 'b', 'o', 'm', 'b', m3_MARKER}
+	bomb = append(bomb, make([]byte, 1000)...)
+	bomb = append(bomb, 2, 0, 0, m4_MARKER|1, 0, 0)
+	size := int64(4 + 255*1000 + 33 + 2)
+
+	decoders := map[string]func(Limit) ([]byte, error){
+		"Decompress1XLimit": func(l Limit) ([]byte, error) {
+			return Decompress1XLimit(bytes.NewReader(bomb), 0, l)
+		},
+		"AppendDecompress1XLimit": func(l Limit) ([]byte, error) {
+			return AppendDecompress1XLimit(nil, bomb, l)
+		},
+		"Decompressor": func(l Limit) ([]byte, error) {
+			d := NewDecompressor(bytes.NewReader(bomb))
+			d.SetLimit(l)
+			return d.Decompress(0)
+		},
+		"Reader": func(l Limit) ([]byte, error) {
+			z := NewReader(bytes.NewReader(bomb))
+			z.SetLimit(l)
+			return ioutil.ReadAll(z)
+		},
+	}
+	for name, dec := range decoders {
+		out, err := dec(Limit{Max: 1000})
+		if !errors.Is(err, OutputOverrun) {
+			t.Errorf("%s: output overrun expected, found: %v", name, err)
+		}
+		if len(out) != 4 {
+			t.Errorf("%s: partial output has %d bytes", name, len(out))
+		}
+
+		if _, err := dec(Limit{Max: size + 1, Exact: true}); !errors.Is(err, OutputUnderrun) {
+			t.Errorf("%s: output underrun expected, found: %v", name, err)
+		}
+		out, err = dec(Limit{Max: size, Exact: true})
+		if err != nil || int64(len(out)) != size {
+			t.Errorf("%s: exact size not accepted: %d, %v", name, len(out), err)
+		}
+		if _, err := dec(Limit{}); err != nil {
+			t.Errorf("%s: unexpected error without limit: %v", name, err)
+		}
+		for _, exact := range []bool{false, true} {
+			if _, err := dec(Limit{Max: -5, Exact: exact}); !errors.Is(err, InvalidLimit) {
+				t.Errorf("%s: invalid limit expected, found: %v", name, err)
+			}
+		}
+		// Not preallocated, as it would not fit in memory
+		if _, err := dec(Limit{Max: 1 << 60, Exact: true}); !errors.Is(err, OutputUnderrun) {
+			t.Errorf("%s: output underrun expected, found: %v", name, err)
+		}
+	}
 }
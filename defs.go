@@ -22,8 +22,56 @@ const (
 	m4_MARKER = 16
 )
 
+// LZO-RLE encodes runs of zeros as M4 matches with the maximum offset, so
+// that real matches are limited to one byte less.
 const (
-	d_BITS = 14
-	d_MASK = (1 << d_BITS) - 1
-	d_HIGH = (d_MASK >> 1) + 1
+	m4_MAX_OFFSET_V1 = m4_MAX_OFFSET - 1
+	zr_MIN_LEN       = 4
+	zr_MAX_LEN       = 2047 + zr_MIN_LEN
 )
+
+// Size of the LZO1X-1 hash table, in bits: 14 by default, and 11, 12 or 15
+// for the LZO1X-1(11), LZO1X-1(12) and LZO1X-1(15) variants.
+const (
+	d_BITS     = 14
+	d_MIN_BITS = 11
+	d_MAX_BITS = 15
+)
+
+// variant identifies a member of the LZO1X family. LZO1Y and LZO1Z use the
+// same instructions as LZO1X, but encode M2 matches differently, with other
+// limits on their offset and length. LZO1Z also stores all the offsets with
+// their most significant bits first, and its M2 matches can repeat the
+// offset of the previous match.
+type variant uint8
+
+const (
+	lzo1x variant = iota
+	lzo1y
+	lzo1z
+)
+
+// Maximum offset of M2 matches (m2_MAX_OFFSET for LZO1X)
+func (v variant) m2MaxOffset() int {
+	switch v {
+	case lzo1y:
+		return 0x0400
+	case lzo1z:
+		return 0x0700
+	}
+	return m2_MAX_OFFSET
+}
+
+// Maximum length of M2 matches (m2_MAX_LEN for LZO1X)
+func (v variant) m2MaxLen() int {
+	if v == lzo1y {
+		return 14
+	}
+	return m2_MAX_LEN
+}
+
+// Maximum offset of the 3 bytes M1 matches that follow a literal run of 4
+// or more bytes (mX_MAX_OFFSET for LZO1X)
+func (v variant) mxMaxOffset() int {
+	return m1_MAX_OFFSET + v.m2MaxOffset()
+}
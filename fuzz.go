@@ -6,5 +6,6 @@ import "bytes"
 
 func Fuzz(data []byte) int {
 	Decompress1X(bytes.NewBuffer(data), 0, 0)
+	AppendDecompress1X(nil, data)
 	return 0
 }
@@ -0,0 +1,203 @@
+package lzo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// HadoopDefaultBlockSize is the amount of uncompressed data that
+// HadoopWriter compresses in every block. It is the default buffer size of
+// LzoCodec (256 KiB) minus the worst-case LZO1X expansion, which is what
+// Hadoop's BlockCompressorStream accepts as input for each block.
+const HadoopDefaultBlockSize = 256*1024 - (256*1024/16 + 64 + 3)
+
+const hadoopMaxBlockSize = 64 * 1024 * 1024
+
+var InvalidHadoopBlock = errors.New("lzo: invalid hadoop block")
+
+// HadoopReader is an io.Reader that decompresses data written by Hadoop's
+// com.hadoop.compression.lzo.LzoCodec (that is, the framing implemented by
+// BlockCompressorStream).
+//
+// The stream is a sequence of blocks; each block starts with the big-endian
+// 32-bit length of its uncompressed data, followed by one or more chunks,
+// each made of a big-endian 32-bit length and a raw LZO1X stream.
+type HadoopReader struct {
+	r   io.Reader
+	d   Decompressor
+	br  bytes.Reader
+	buf []byte
+	out []byte
+	cur []byte
+	err error
+}
+
+// NewHadoopReader creates a new HadoopReader reading from r.
+func NewHadoopReader(r io.Reader) *HadoopReader {
+	return &HadoopReader{r: r}
+}
+
+// Decode a whole block into z.cur.
+func (z *HadoopReader) nextBlock() error {
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(z.r, hdr[:]); err != nil {
+		// io.EOF here is the regular end of the stream
+		return err
+	}
+	blen := binary.BigEndian.Uint32(hdr[:])
+	if blen == 0 {
+		// Hadoop writes a zero length block for an empty file, and
+		// stops reading when it finds one.
+		return io.EOF
+	}
+	if blen > hadoopMaxBlockSize {
+		return InvalidHadoopBlock
+	}
+
+	z.out = z.out[:0]
+	for len(z.out) < int(blen) {
+		if _, err := io.ReadFull(z.r, hdr[:]); err != nil {
+			return noEOF(err)
+		}
+		clen := binary.BigEndian.Uint32(hdr[:])
+		if clen == 0 || clen > hadoopMaxBlockSize {
+			return InvalidHadoopBlock
+		}
+		if cap(z.buf) < int(clen) {
+			z.buf = make([]byte, clen)
+		}
+		z.buf = z.buf[:clen]
+		if _, err := io.ReadFull(z.r, z.buf); err != nil {
+			return noEOF(err)
+		}
+
+		z.br.Reset(z.buf)
+		z.d.Reset(&z.br)
+		z.d.SetLimit(Limit{Max: int64(blen) - int64(len(z.out))})
+		out, err := z.d.AppendDecompress(z.out, len(z.buf))
+		if err != nil {
+			return err
+		}
+		z.out = out
+	}
+	z.cur = z.out
+	return nil
+}
+
+// Read implements io.Reader, reading uncompressed bytes from the stream.
+func (z *HadoopReader) Read(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	for len(z.cur) == 0 {
+		if z.err = z.nextBlock(); z.err != nil {
+			return 0, z.err
+		}
+	}
+	n = copy(p, z.cur)
+	z.cur = z.cur[n:]
+	return n, nil
+}
+
+// HadoopWriter is an io.WriteCloser that compresses data in the framing used
+// by Hadoop's com.hadoop.compression.lzo.LzoCodec, so that it can be read by
+// Hadoop jobs. Each block is written as a single chunk.
+type HadoopWriter struct {
+	// BlockSize is the amount of uncompressed data compressed in each
+	// block. It can be changed before the first call to Write; Hadoop
+	// refuses blocks whose compressed size exceeds the buffer size it is
+	// configured with, so it should not be raised above the default unless
+	// the readers are configured accordingly.
+	BlockSize int
+
+	w      io.Writer
+	level  Level
+	buf    []byte
+	closed bool
+	err    error
+}
+
+// NewHadoopWriter creates a new HadoopWriter writing to w, that compresses
+// data with LZO1X-1 like Hadoop does by default.
+func NewHadoopWriter(w io.Writer) *HadoopWriter {
+	z, _ := NewHadoopWriterLevel(w, 0)
+	return z
+}
+
+// NewHadoopWriterLevel creates a new HadoopWriter writing to w. Level 0
+// selects LZO1X-1, while levels 1 to 9 select LZO1X-999 with that
+// compression level.
+func NewHadoopWriterLevel(w io.Writer, level Level) (*HadoopWriter, error) {
+	if err := level.check(BestSpeed); err != nil {
+		return nil, err
+	}
+	return &HadoopWriter{w: w, level: level, BlockSize: HadoopDefaultBlockSize}, nil
+}
+
+func (z *HadoopWriter) writeBlock(data []byte) error {
+	var cmp []byte
+	if z.level == 0 {
+		cmp = Compress1X(data)
+	} else {
+		cmp = Compress1X999Level(data, int(z.level))
+	}
+
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(cmp)))
+	if _, err := z.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := z.w.Write(cmp)
+	return err
+}
+
+// Write compresses p, writing a block to the underlying writer each time
+// BlockSize bytes have been accumulated.
+func (z *HadoopWriter) Write(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errors.New("lzo: write on closed hadoop writer")
+	}
+	if z.BlockSize <= 0 || z.BlockSize > hadoopMaxBlockSize {
+		z.err = fmt.Errorf("lzo: invalid hadoop block size: %d", z.BlockSize)
+		return 0, z.err
+	}
+
+	for len(p) > 0 {
+		m := z.BlockSize - len(z.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		z.buf = append(z.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(z.buf) == z.BlockSize {
+			if z.err = z.writeBlock(z.buf); z.err != nil {
+				return n, z.err
+			}
+			z.buf = z.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Close compresses any pending data. It does not close the underlying
+// writer.
+func (z *HadoopWriter) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	z.closed = true
+	if len(z.buf) > 0 {
+		z.err = z.writeBlock(z.buf)
+		z.buf = z.buf[:0]
+	}
+	return z.err
+}
@@ -0,0 +1,64 @@
+package lzo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestHadoopRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("hadoop lzo codec "), 40000)
+	for _, level := range []Level{0, 3} {
+		var buf bytes.Buffer
+		z, err := NewHadoopWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.Write(data[:1000])
+		z.Write(data[1000:])
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data2, err := ioutil.ReadAll(NewHadoopReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, data2) {
+			t.Error("data doesn't match for level", level)
+		}
+	}
+}
+
+func TestHadoopReaderChunks(t *testing.T) {
+	// A block split into several chunks, as BlockCompressorStream writes
+	// when a single write is larger than its buffer.
+	parts := [][]byte{
+		bytes.Repeat([]byte("a"), 5000),
+		bytes.Repeat([]byte("bc"), 3000),
+		[]byte("d"),
+	}
+	var file bytes.Buffer
+	binary.Write(&file, binary.BigEndian, uint32(5000+6000+1))
+	for _, p := range parts {
+		cmp := Compress1X(p)
+		binary.Write(&file, binary.BigEndian, uint32(len(cmp)))
+		file.Write(cmp)
+	}
+	full := file.Bytes()
+
+	data, err := ioutil.ReadAll(NewHadoopReader(bytes.NewReader(full)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Join(parts, nil)) {
+		t.Error("data doesn't match")
+	}
+
+	_, err = ioutil.ReadAll(NewHadoopReader(bytes.NewReader(full[:len(full)-2])))
+	if err != io.ErrUnexpectedEOF {
+		t.Error("unexpected EOF expected, found:", err)
+	}
+}
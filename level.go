@@ -0,0 +1,54 @@
+package lzo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Level selects the compression algorithm: level 0 is LZO1X-1, the fastest,
+// while levels 1 to 9 are LZO1X-999 with increasing compression ratio and
+// decreasing speed. The functions and constructors that take a Level, like
+// CompressLevel, return an error wrapping InvalidLevel if it is out of
+// range. Compress1X999Level and AppendCompress1X999Level, which take the
+// level as an int instead, panic if it is invalid.
+type Level int
+
+const (
+	BestSpeed       Level = 0 // LZO1X-1
+	BestCompression Level = 9 // LZO1X-999 at its highest level
+)
+
+// InvalidLevel is the error returned for compression levels outside the
+// supported range.
+var InvalidLevel = errors.New("invalid compression level")
+
+func (l Level) check(min Level) error {
+	if l < min || l > BestCompression {
+		return fmt.Errorf("lzo: %w: %d", InvalidLevel, int(l))
+	}
+	return nil
+}
+
+// Params returns the LZO1X-999 parameters that the level uses, which can
+// be a starting point for Compress1X999Params. It fails for level 0, that
+// is not LZO1X-999.
+func (l Level) Params() (Params, error) {
+	if err := l.check(1); err != nil {
+		return Params{}, err
+	}
+	return fixedLevels[l-1], nil
+}
+
+// CompressLevel compresses in with LZO1X-1 or LZO1X-999, depending on the
+// level. Unlike Compress1X999Level, it returns an error if the level is
+// invalid.
+func CompressLevel(in []byte, level Level) ([]byte, error) {
+	if level == BestSpeed {
+		return Compress1X(in), nil
+	}
+	p, err := level.Params()
+	if err != nil {
+		return nil, err
+	}
+	return Compress1X999Params(in, p)
+}
@@ -0,0 +1,582 @@
+package lzo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+var lzopMagic = [9]byte{0x89, 'L', 'Z', 'O', 0x00, 0x0d, 0x0a, 0x1a, 0x0a}
+
+// Methods that can appear in the method field of a lzop header. All of them
+// produce a LZO1X bitstream.
+const (
+	LzopMethod1X1    = 1
+	LzopMethod1X1_15 = 2
+	LzopMethod1X999  = 3
+)
+
+// Flags of a lzop header that select which checksums are stored with every
+// block. The D variants cover the uncompressed data of a block, and the C
+// variants the compressed data. LzopFlagHeaderCRC32 selects CRC-32 instead of
+// Adler-32 for the checksum of the header itself.
+const (
+	LzopFlagAdler32D    = 0x00000001
+	LzopFlagAdler32C    = 0x00000002
+	LzopFlagCRC32D      = 0x00000100
+	LzopFlagCRC32C      = 0x00000200
+	LzopFlagHeaderCRC32 = 0x00001000
+)
+
+const (
+	lzopFlagExtraField = 0x00000040
+	lzopFlagMultipart  = 0x00000400
+	lzopFlagFilter     = 0x00000800
+
+	lzopFlagOSUnix = 0x03000000
+)
+
+const (
+	lzopMinVersion   = 0x0900
+	lzopVersion      = 0x1040
+	lzopLibVersion   = 0x20a0
+	lzopNeedVersion  = 0x0940
+	lzopMaxBlockSize = 64 * 1024 * 1024
+)
+
+var (
+	InvalidLzopHeader = errors.New("lzop: invalid header")
+	InvalidLzopBlock  = errors.New("lzop: invalid block")
+	UnsupportedLzop   = errors.New("lzop: unsupported version, method or flags")
+)
+
+// LzopChecksumError is returned by LzopReader when the checksum stored for a
+// block doesn't match its data.
+type LzopChecksumError struct {
+	Block      int  // index of the block, counting from the first one read
+	Compressed bool // whether the checksum covers the compressed data
+	CRC32      bool // whether the checksum is CRC-32 rather than Adler-32
+	Want, Got  uint32
+}
+
+func (e *LzopChecksumError) Error() string {
+	alg := "adler32"
+	if e.CRC32 {
+		alg = "crc32"
+	}
+	data := "uncompressed"
+	if e.Compressed {
+		data = "compressed"
+	}
+	return fmt.Sprintf("lzop: %s mismatch on %s data of block %d (stored %08x, computed %08x)",
+		alg, data, e.Block, e.Want, e.Got)
+}
+
+// LzopHeader is the metadata stored at the beginning of every member of a
+// lzop file.
+type LzopHeader struct {
+	Version       uint16
+	LibVersion    uint16
+	VersionNeeded uint16
+	Method        byte
+	Level         byte
+	Flags         uint32
+	Mode          uint32
+	ModTime       time.Time
+	Name          string
+	Extra         []byte
+}
+
+// LzopReader is an io.Reader that decompresses a file in the format written
+// by the lzop tool.
+//
+// A lzop file can be the concatenation of several members, each with its
+// own header; LzopReader decodes all of them as a single stream, and the
+// embedded LzopHeader always describes the member being currently read.
+type LzopReader struct {
+	LzopHeader
+	r     io.Reader
+	d     Decompressor
+	br    bytes.Reader
+	buf   []byte
+	cur   []byte
+	block int
+	err   error
+}
+
+// NewLzopReader creates a new LzopReader reading from r. The header of the
+// first member is read immediately and is available in the embedded
+// LzopHeader.
+func NewLzopReader(r io.Reader) (*LzopReader, error) {
+	z := &LzopReader{r: r}
+	if err := z.readMagic(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err := z.readHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Read the magic at the beginning of a member. io.EOF is returned only if
+// there are no bytes at all.
+func (z *LzopReader) readMagic() error {
+	var magic [len(lzopMagic)]byte
+	if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+		return err
+	}
+	if magic != lzopMagic {
+		return InvalidLzopHeader
+	}
+	return nil
+}
+
+func (z *LzopReader) readHeader() error {
+	var buf [4]byte
+	var h LzopHeader
+
+	// Everything from the version up to the name is covered by the header
+	// checksum, whose algorithm is only known after the flags are read.
+	var raw bytes.Buffer
+	hr := io.TeeReader(z.r, &raw)
+	read := func(n int) []byte {
+		if _, err := io.ReadFull(hr, buf[:n]); err != nil {
+			if z.err == nil {
+				z.err = noEOF(err)
+			}
+			return make([]byte, n)
+		}
+		return buf[:n]
+	}
+
+	h.Version = binary.BigEndian.Uint16(read(2))
+	h.LibVersion = binary.BigEndian.Uint16(read(2))
+	if h.Version >= 0x0940 {
+		h.VersionNeeded = binary.BigEndian.Uint16(read(2))
+	}
+	h.Method = read(1)[0]
+	if h.Version >= 0x0940 {
+		h.Level = read(1)[0]
+	}
+	h.Flags = binary.BigEndian.Uint32(read(4))
+	var filter uint32
+	if h.Flags&lzopFlagFilter != 0 {
+		filter = binary.BigEndian.Uint32(read(4))
+	}
+	h.Mode = binary.BigEndian.Uint32(read(4))
+	mtime := int64(binary.BigEndian.Uint32(read(4)))
+	if h.Version >= 0x0940 {
+		mtime |= int64(binary.BigEndian.Uint32(read(4))) << 32
+	}
+	if mtime != 0 {
+		h.ModTime = time.Unix(mtime, 0)
+	}
+	name := make([]byte, read(1)[0])
+	if _, err := io.ReadFull(hr, name); err != nil && z.err == nil {
+		z.err = noEOF(err)
+	}
+	h.Name = string(name)
+	if z.err != nil {
+		return z.err
+	}
+
+	if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+		z.err = noEOF(err)
+		return z.err
+	}
+	if binary.BigEndian.Uint32(buf[:4]) != lzopHeaderSum(h.Flags, raw.Bytes()) {
+		z.err = InvalidLzopHeader
+		return z.err
+	}
+
+	if h.Flags&lzopFlagExtraField != 0 {
+		if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+			z.err = noEOF(err)
+			return z.err
+		}
+		n := binary.BigEndian.Uint32(buf[:4])
+		if n > lzopMaxBlockSize {
+			z.err = InvalidLzopHeader
+			return z.err
+		}
+		h.Extra = make([]byte, n)
+		if _, err := io.ReadFull(z.r, h.Extra); err != nil {
+			z.err = noEOF(err)
+			return z.err
+		}
+		if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+			z.err = noEOF(err)
+			return z.err
+		}
+	}
+
+	if h.Version < lzopMinVersion || h.VersionNeeded > lzopVersion {
+		z.err = UnsupportedLzop
+		return z.err
+	}
+	switch h.Method {
+	case LzopMethod1X1, LzopMethod1X1_15, LzopMethod1X999:
+	default:
+		z.err = UnsupportedLzop
+		return z.err
+	}
+	if filter != 0 || h.Flags&lzopFlagMultipart != 0 {
+		z.err = UnsupportedLzop
+		return z.err
+	}
+
+	z.LzopHeader = h
+	return nil
+}
+
+// Compute the checksum of the raw header bytes, with the algorithm selected
+// by flags.
+func lzopHeaderSum(flags uint32, raw []byte) uint32 {
+	if flags&LzopFlagHeaderCRC32 != 0 {
+		return crc32.ChecksumIEEE(raw)
+	}
+	return adler32.Checksum(raw)
+}
+
+// Read the header of a block: its uncompressed and compressed lengths, and
+// the checksums enabled by the header flags, in the order Adler-32 and
+// CRC-32 of the uncompressed data, and Adler-32 and CRC-32 of the compressed
+// data. A zero dstLen marks the end of the member.
+func (z *LzopReader) readBlockHeader() (dstLen, srcLen uint32, sums [4]uint32, err error) {
+	var buf [4]byte
+
+	if _, err = io.ReadFull(z.r, buf[:]); err != nil {
+		err = noEOF(err)
+		return
+	}
+	dstLen = binary.BigEndian.Uint32(buf[:])
+	if dstLen == 0 {
+		return
+	}
+	if dstLen > lzopMaxBlockSize {
+		err = InvalidLzopBlock
+		return
+	}
+	if _, err = io.ReadFull(z.r, buf[:]); err != nil {
+		err = noEOF(err)
+		return
+	}
+	srcLen = binary.BigEndian.Uint32(buf[:])
+	if srcLen == 0 || srcLen > dstLen {
+		err = InvalidLzopBlock
+		return
+	}
+
+	// Checksums of the compressed data are omitted for stored blocks, as
+	// they would be equal to those of the uncompressed data.
+	for i, f := range [4]uint32{LzopFlagAdler32D, LzopFlagCRC32D, LzopFlagAdler32C, LzopFlagCRC32C} {
+		if z.Flags&f == 0 || (i >= 2 && srcLen == dstLen) {
+			continue
+		}
+		if _, err = io.ReadFull(z.r, buf[:]); err != nil {
+			err = noEOF(err)
+			return
+		}
+		sums[i] = binary.BigEndian.Uint32(buf[:])
+	}
+	return
+}
+
+// Read the next block of the current member into z.cur. At the end of a
+// member, the following one (if any) is started.
+func (z *LzopReader) nextBlock() error {
+	var dstLen, srcLen uint32
+	var sums [4]uint32
+	for {
+		var err error
+		dstLen, srcLen, sums, err = z.readBlockHeader()
+		if err != nil {
+			return err
+		}
+		if dstLen != 0 {
+			break
+		}
+
+		// End of member: either the input is over, or another member follows
+		if err := z.readMagic(); err != nil {
+			return err
+		}
+		if err := z.readHeader(); err != nil {
+			return err
+		}
+	}
+
+	if cap(z.buf) < int(srcLen) {
+		z.buf = make([]byte, srcLen)
+	}
+	z.buf = z.buf[:srcLen]
+	if _, err := io.ReadFull(z.r, z.buf); err != nil {
+		return noEOF(err)
+	}
+
+	block := z.block
+	z.block++
+
+	out := z.buf
+	if srcLen < dstLen {
+		if err := z.verify(block, true, z.buf, sums[2], sums[3]); err != nil {
+			return err
+		}
+		var err error
+		z.br.Reset(z.buf)
+		z.d.Reset(&z.br)
+		z.d.SetLimit(Limit{Max: int64(dstLen), Exact: true})
+		out, err = z.d.Decompress(len(z.buf))
+		if err != nil {
+			return err
+		}
+	}
+	if err := z.verify(block, false, out, sums[0], sums[1]); err != nil {
+		return err
+	}
+	z.cur = out
+	return nil
+}
+
+// Verify the Adler-32 and CRC-32 checksums of data, for those enabled by
+// the header flags.
+func (z *LzopReader) verify(block int, compressed bool, data []byte, adler, crc uint32) error {
+	fadler, fcrc := uint32(LzopFlagAdler32D), uint32(LzopFlagCRC32D)
+	if compressed {
+		fadler, fcrc = LzopFlagAdler32C, LzopFlagCRC32C
+	}
+	if z.Flags&fadler != 0 {
+		if sum := adler32.Checksum(data); sum != adler {
+			return &LzopChecksumError{Block: block, Compressed: compressed, Want: adler, Got: sum}
+		}
+	}
+	if z.Flags&fcrc != 0 {
+		if sum := crc32.ChecksumIEEE(data); sum != crc {
+			return &LzopChecksumError{Block: block, Compressed: compressed, CRC32: true, Want: crc, Got: sum}
+		}
+	}
+	return nil
+}
+
+// Read implements io.Reader, reading uncompressed bytes from the lzop file.
+func (z *LzopReader) Read(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	for len(z.cur) == 0 {
+		if z.err = z.nextBlock(); z.err != nil {
+			return 0, z.err
+		}
+	}
+	n = copy(p, z.cur)
+	z.cur = z.cur[n:]
+	return n, nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// LzopDefaultBlockSize is the amount of uncompressed data that LzopWriter
+// compresses in every block, unless configured otherwise.
+const LzopDefaultBlockSize = 256 * 1024
+
+// LzopWriter is an io.WriteCloser that compresses data in the format of the
+// lzop tool, so that it can be decompressed with "lzop -d".
+//
+// The fields of the embedded LzopHeader can be changed before the first call
+// to Write or Close; Name, Mode and ModTime are the ones that are meaningful
+// to set, while the others are filled by the writer. The checksums stored
+// with every block are selected by setting the LzopFlag constants in Flags;
+// by default, like lzop, only the Adler-32 of the uncompressed data is
+// stored.
+type LzopWriter struct {
+	LzopHeader
+
+	// BlockSize is the amount of uncompressed data that is compressed
+	// independently in each block. It can be changed before the first call
+	// to Write, and must not exceed 64 MiB.
+	BlockSize int
+
+	w           io.Writer
+	level       Level
+	buf         []byte
+	wroteHeader bool
+	closed      bool
+	err         error
+}
+
+// NewLzopWriter creates a new LzopWriter writing to w, that compresses data
+// with LZO1X-1.
+func NewLzopWriter(w io.Writer) *LzopWriter {
+	z, _ := NewLzopWriterLevel(w, 0)
+	return z
+}
+
+// NewLzopWriterLevel creates a new LzopWriter writing to w. Level 0 selects
+// LZO1X-1, while levels 1 to 9 select LZO1X-999 with that compression level.
+func NewLzopWriterLevel(w io.Writer, level Level) (*LzopWriter, error) {
+	if err := level.check(BestSpeed); err != nil {
+		return nil, err
+	}
+	z := &LzopWriter{w: w, level: level, BlockSize: LzopDefaultBlockSize}
+	z.Version = lzopVersion
+	z.LibVersion = lzopLibVersion
+	z.VersionNeeded = lzopNeedVersion
+	if level == 0 {
+		// Same as lzop's default (-3)
+		z.Method = LzopMethod1X1
+		z.Level = 3
+	} else {
+		z.Method = LzopMethod1X999
+		z.Level = byte(level)
+	}
+	z.Flags = lzopFlagOSUnix | LzopFlagAdler32D
+	z.Mode = 0644
+	return z, nil
+}
+
+func (z *LzopWriter) writeHeader() error {
+	if len(z.Name) > 255 {
+		return errors.New("lzop: file name too long")
+	}
+	if z.BlockSize <= 0 || z.BlockSize > lzopMaxBlockSize {
+		return fmt.Errorf("lzop: invalid block size: %d", z.BlockSize)
+	}
+	z.Flags &^= lzopFlagFilter | lzopFlagExtraField | lzopFlagMultipart
+
+	var mtime int64
+	if !z.ModTime.IsZero() {
+		mtime = z.ModTime.Unix()
+	}
+
+	hdr := make([]byte, 0, 64+len(z.Name))
+	hdr = appendU16(hdr, z.Version)
+	hdr = appendU16(hdr, z.LibVersion)
+	hdr = appendU16(hdr, z.VersionNeeded)
+	hdr = append(hdr, z.Method, z.Level)
+	hdr = appendU32(hdr, z.Flags)
+	hdr = appendU32(hdr, z.Mode)
+	hdr = appendU32(hdr, uint32(mtime))
+	hdr = appendU32(hdr, uint32(mtime>>32))
+	hdr = append(hdr, byte(len(z.Name)))
+	hdr = append(hdr, z.Name...)
+	hdr = appendU32(hdr, lzopHeaderSum(z.Flags, hdr))
+
+	if _, err := z.w.Write(lzopMagic[:]); err != nil {
+		return err
+	}
+	_, err := z.w.Write(hdr)
+	return err
+}
+
+func (z *LzopWriter) writeBlock(data []byte) error {
+	var cmp []byte
+	if z.level == 0 {
+		cmp = Compress1X(data)
+	} else {
+		cmp = Compress1X999Level(data, int(z.level))
+	}
+	if len(cmp) >= len(data) {
+		cmp = data
+	}
+
+	hdr := make([]byte, 0, 24)
+	hdr = appendU32(hdr, uint32(len(data)))
+	hdr = appendU32(hdr, uint32(len(cmp)))
+	if z.Flags&LzopFlagAdler32D != 0 {
+		hdr = appendU32(hdr, adler32.Checksum(data))
+	}
+	if z.Flags&LzopFlagCRC32D != 0 {
+		hdr = appendU32(hdr, crc32.ChecksumIEEE(data))
+	}
+	if len(cmp) < len(data) {
+		if z.Flags&LzopFlagAdler32C != 0 {
+			hdr = appendU32(hdr, adler32.Checksum(cmp))
+		}
+		if z.Flags&LzopFlagCRC32C != 0 {
+			hdr = appendU32(hdr, crc32.ChecksumIEEE(cmp))
+		}
+	}
+	if _, err := z.w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := z.w.Write(cmp)
+	return err
+}
+
+// Write compresses p, writing a block to the underlying writer each time
+// BlockSize bytes have been accumulated.
+func (z *LzopWriter) Write(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errors.New("lzop: write on closed writer")
+	}
+	if !z.wroteHeader {
+		z.wroteHeader = true
+		if z.err = z.writeHeader(); z.err != nil {
+			return 0, z.err
+		}
+	}
+
+	for len(p) > 0 {
+		m := z.BlockSize - len(z.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		z.buf = append(z.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(z.buf) == z.BlockSize {
+			if z.err = z.writeBlock(z.buf); z.err != nil {
+				return n, z.err
+			}
+			z.buf = z.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Close compresses any pending data and writes the end-of-file marker. It
+// does not close the underlying writer.
+func (z *LzopWriter) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	if !z.wroteHeader {
+		z.wroteHeader = true
+		if z.err = z.writeHeader(); z.err != nil {
+			return z.err
+		}
+	}
+	z.closed = true
+	if len(z.buf) > 0 {
+		if z.err = z.writeBlock(z.buf); z.err != nil {
+			return z.err
+		}
+		z.buf = z.buf[:0]
+	}
+	_, z.err = z.w.Write([]byte{0, 0, 0, 0})
+	return z.err
+}
+
+func appendU16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,253 @@
+package lzo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// LzopIndex lists the file offsets of the blocks of a lzop file, in the
+// same layout as the .lzo.index files created by Hadoop-LZO's LzoIndexer:
+// each offset points to the uncompressed length that starts a block, and
+// is serialized as a big-endian 64-bit integer.
+//
+// Like Hadoop-LZO, only the first member of a multi-member file is indexed.
+type LzopIndex []int64
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// IndexLzop scans the lzop file read from r, and returns the offsets of its
+// blocks. Block data is skipped without being decompressed or verified.
+func IndexLzop(r io.Reader) (LzopIndex, error) {
+	cr := &countingReader{r: r}
+	z := &LzopReader{r: cr}
+	if err := z.readMagic(); err != nil {
+		return nil, noEOF(err)
+	}
+	if err := z.readHeader(); err != nil {
+		return nil, err
+	}
+
+	var idx LzopIndex
+	for {
+		pos := cr.n
+		dstLen, srcLen, _, err := z.readBlockHeader()
+		if err != nil {
+			return nil, err
+		}
+		if dstLen == 0 {
+			return idx, nil
+		}
+		idx = append(idx, pos)
+		if _, err := io.CopyN(io.Discard, cr, int64(srcLen)); err != nil {
+			return nil, noEOF(err)
+		}
+	}
+}
+
+// WriteLzopIndex scans the lzop file read from r, and writes its index to w.
+func WriteLzopIndex(w io.Writer, r io.Reader) error {
+	idx, err := IndexLzop(r)
+	if err != nil {
+		return err
+	}
+	_, err = idx.WriteTo(w)
+	return err
+}
+
+// ReadLzopIndex reads an index in the format written by WriteTo.
+func ReadLzopIndex(r io.Reader) (LzopIndex, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%8 != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	idx := make(LzopIndex, len(data)/8)
+	for i := range idx {
+		idx[i] = int64(binary.BigEndian.Uint64(data[i*8:]))
+	}
+	return idx, nil
+}
+
+// WriteTo writes the index to w, implementing io.WriterTo.
+func (idx LzopIndex) WriteTo(w io.Writer) (int64, error) {
+	data := make([]byte, len(idx)*8)
+	for i, off := range idx {
+		binary.BigEndian.PutUint64(data[i*8:], uint64(off))
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// NewLzopReaderAt creates a LzopReader that decompresses the lzop file
+// available through r starting from the block at the given offset, that
+// must be one of the offsets of its index. The header is read from the
+// beginning of the file, as it is needed to decode the blocks.
+func NewLzopReaderAt(r io.ReaderAt, offset int64) (*LzopReader, error) {
+	z, err := NewLzopReader(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	z.r = io.NewSectionReader(r, offset, math.MaxInt64-offset)
+	return z, nil
+}
+
+// LzopSplit is a range of blocks of an indexed lzop file, from block Start
+// (included) to block End (excluded), that can be processed independently
+// of the others.
+type LzopSplit struct {
+	Start, End int
+}
+
+// Splits divides the indexed file in consecutive splits, each spanning at
+// least size bytes of compressed data (except the last one), the same way
+// Hadoop aligns its input splits to block boundaries.
+func (idx LzopIndex) Splits(size int64) []LzopSplit {
+	var splits []LzopSplit
+	start := 0
+	for i := 1; i < len(idx); i++ {
+		if idx[i]-idx[start] >= size {
+			splits = append(splits, LzopSplit{start, i})
+			start = i
+		}
+	}
+	if start < len(idx) {
+		splits = append(splits, LzopSplit{start, len(idx)})
+	}
+	return splits
+}
+
+// NewLzopLineReader returns a reader for the lines of text that belong to
+// split s of the lzop file available through r, whose index is idx.
+//
+// A line belongs to the split that contains its first byte, so the reader
+// skips the partial line at the beginning of the split, and reads past its
+// end to complete the last line. Reading every split of a file thus yields
+// every line exactly once, which is what Hadoop's LineRecordReader does.
+func NewLzopLineReader(r io.ReaderAt, idx LzopIndex, s LzopSplit) (io.Reader, error) {
+	if s.Start < 0 || s.End > len(idx) || s.Start > s.End {
+		return nil, InvalidLzopBlock
+	}
+	if s.Start == s.End {
+		return eofReader{}, nil
+	}
+
+	// Decoding starts one block earlier, so that it is possible to tell
+	// whether the split begins at a line boundary.
+	lr := &lzopLineReader{end: -1, started: true}
+	first := s.Start
+	if first > 0 {
+		first--
+		lr.started = false
+	}
+	if !lr.started || s.End < len(idx) {
+		lr.end = 0
+		for i := first; i < s.End; i++ {
+			var buf [4]byte
+			if _, err := r.ReadAt(buf[:], idx[i]); err != nil {
+				return nil, noEOF(err)
+			}
+			n := int64(binary.BigEndian.Uint32(buf[:]))
+			if i < s.Start {
+				lr.start = n
+			}
+			lr.end += n
+		}
+		if s.End == len(idx) {
+			lr.end = -1
+		}
+	}
+
+	var err error
+	lr.z, err = NewLzopReaderAt(r, idx[first])
+	if err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// lzopLineReader filters the output of a LzopReader, returning only the
+// lines that begin within [start, end) of its output (end < 0 means that
+// there is no end limit).
+type lzopLineReader struct {
+	z       *LzopReader
+	pos     int64
+	start   int64
+	end     int64
+	started bool
+	done    bool
+}
+
+func (lr *lzopLineReader) Read(p []byte) (int, error) {
+	for !lr.done {
+		n, err := lr.z.Read(p)
+		data := p[:n]
+		base := lr.pos
+		lr.pos += int64(n)
+
+		if !lr.started {
+			i := indexNewline(data, base, lr.start-1)
+			if i < 0 {
+				data = nil
+			} else {
+				lr.started = true
+				base += int64(i + 1)
+				data = data[i+1:]
+				if lr.end >= 0 && base >= lr.end {
+					// No line begins within the split
+					lr.done = true
+					data = nil
+				}
+			}
+		}
+		if lr.started && !lr.done && lr.end >= 0 {
+			if i := indexNewline(data, base, lr.end-1); i >= 0 {
+				data = data[:i+1]
+				lr.done = true
+			}
+		}
+
+		if len(data) > 0 {
+			if lr.done {
+				err = nil
+			}
+			return copy(p, data), err
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Return the index of the first newline of data at or after the offset
+// from, where base is the offset of data[0]; -1 if there is none.
+func indexNewline(data []byte, base, from int64) int {
+	skip := from - base
+	if skip < 0 {
+		skip = 0
+	}
+	if skip >= int64(len(data)) {
+		return -1
+	}
+	if i := bytes.IndexByte(data[skip:], '\n'); i >= 0 {
+		return int(skip) + i
+	}
+	return -1
+}
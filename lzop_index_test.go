@@ -0,0 +1,89 @@
+package lzo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func makeIndexedLzop(t *testing.T, data []byte, blockSize int) ([]byte, LzopIndex) {
+	var buf bytes.Buffer
+	z := NewLzopWriter(&buf)
+	z.BlockSize = blockSize
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ibuf bytes.Buffer
+	if err := WriteLzopIndex(&ibuf, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ReadLzopIndex(&ibuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx) != (len(data)+blockSize-1)/blockSize {
+		t.Fatalf("invalid number of blocks in index: %d", len(idx))
+	}
+	return buf.Bytes(), idx
+}
+
+func TestLzopIndex(t *testing.T) {
+	data := bytes.Repeat([]byte("indexed lzop file "), 2000)
+	file, idx := makeIndexedLzop(t, data, 4096)
+
+	for i, off := range idx {
+		z, err := NewLzopReaderAt(bytes.NewReader(file), off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data2, err := io.ReadAll(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[i*4096:], data2) {
+			t.Error("data doesn't match from block", i)
+		}
+	}
+}
+
+func TestLzopLineSplits(t *testing.T) {
+	var text bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&text, "line %d %s\n", i, strings.Repeat("x", i%37))
+		if i == 1500 {
+			// A line spanning several blocks
+			text.WriteString(strings.Repeat("long", 3000))
+			text.WriteString("\n")
+		}
+	}
+	// Lines of 8 bytes, so that blocks start exactly at line boundaries
+	aligned := bytes.Repeat([]byte("aligned\n"), 4096)
+
+	for _, data := range [][]byte{text.Bytes(), aligned} {
+		file, idx := makeIndexedLzop(t, data, 1024)
+		for _, size := range []int64{1, 500, 3000, 1 << 30} {
+			var out []byte
+			for _, s := range idx.Splits(size) {
+				r, err := NewLzopLineReader(bytes.NewReader(file), idx, s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				part, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(part) > 0 && part[len(part)-1] != '\n' {
+					t.Errorf("split %v doesn't end at a line boundary", s)
+				}
+				out = append(out, part...)
+			}
+			if !bytes.Equal(out, data) {
+				t.Error("splits don't add up to the whole file, split size", size)
+			}
+		}
+	}
+}
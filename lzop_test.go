@@ -0,0 +1,235 @@
+package lzo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Build a lzop member by hand, the same way lzop 1.04 lays it out, with
+// every block compressed with LZO1X-1 unless it would expand.
+func buildLzop(name string, mtime int64, blocks ...[]byte) []byte {
+	var hdr bytes.Buffer
+	binary.Write(&hdr, binary.BigEndian, uint16(0x1040))
+	binary.Write(&hdr, binary.BigEndian, uint16(0x20a0))
+	binary.Write(&hdr, binary.BigEndian, uint16(0x0940))
+	hdr.WriteByte(LzopMethod1X1)
+	hdr.WriteByte(3)
+	binary.Write(&hdr, binary.BigEndian, uint32(0x03000000))
+	binary.Write(&hdr, binary.BigEndian, uint32(0644))
+	binary.Write(&hdr, binary.BigEndian, uint32(mtime))
+	binary.Write(&hdr, binary.BigEndian, uint32(mtime>>32))
+	hdr.WriteByte(byte(len(name)))
+	hdr.WriteString(name)
+
+	var out bytes.Buffer
+	out.Write(lzopMagic[:])
+	out.Write(hdr.Bytes())
+	binary.Write(&out, binary.BigEndian, adler32.Checksum(hdr.Bytes()))
+	for _, b := range blocks {
+		cmp := Compress1X(b)
+		if len(cmp) >= len(b) {
+			cmp = b
+		}
+		binary.Write(&out, binary.BigEndian, uint32(len(b)))
+		binary.Write(&out, binary.BigEndian, uint32(len(cmp)))
+		out.Write(cmp)
+	}
+	binary.Write(&out, binary.BigEndian, uint32(0))
+	return out.Bytes()
+}
+
+func TestLzopReader(t *testing.T) {
+	b1 := bytes.Repeat([]byte("hello, lzop! "), 1000)
+	b2 := []byte("short")
+	file := buildLzop("hello.txt", 1500000000, b1, b2)
+
+	z, err := NewLzopReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.Name != "hello.txt" || z.Method != LzopMethod1X1 || z.Mode != 0644 {
+		t.Errorf("invalid header: %+v", z.LzopHeader)
+	}
+	if !z.ModTime.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("invalid mtime: %v", z.ModTime)
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, append(b1, b2...)) {
+		t.Error("data doesn't match")
+	}
+}
+
+func TestLzopReaderMultiMember(t *testing.T) {
+	b1 := bytes.Repeat([]byte{1, 2, 3, 4}, 5000)
+	b2 := bytes.Repeat([]byte{5, 6, 7}, 5000)
+	file := append(buildLzop("a", 0, b1), buildLzop("b", 0, b2)...)
+
+	z, err := NewLzopReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, append(b1, b2...)) {
+		t.Error("data doesn't match")
+	}
+	if z.Name != "b" {
+		t.Errorf("header not updated for second member: %q", z.Name)
+	}
+}
+
+func TestLzopReaderCorrupt(t *testing.T) {
+	file := buildLzop("x", 0, bytes.Repeat([]byte("abc"), 100))
+
+	bad := append([]byte(nil), file...)
+	bad[12] ^= 0xff
+	if _, err := NewLzopReader(bytes.NewReader(bad)); err != InvalidLzopHeader {
+		t.Error("invalid header expected, found:", err)
+	}
+
+	z, err := NewLzopReader(bytes.NewReader(file[:len(file)-10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(z); err != io.ErrUnexpectedEOF {
+		t.Error("unexpected EOF expected, found:", err)
+	}
+}
+
+func TestLzopWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 50000)
+	for _, level := range []Level{0, 1, 9} {
+		var buf bytes.Buffer
+		z, err := NewLzopWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.Name = "data.bin"
+		z.ModTime = time.Unix(1234567890, 0)
+		z.BlockSize = 100000
+		if _, err := z.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewLzopReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Name != "data.bin" || !r.ModTime.Equal(z.ModTime) {
+			t.Errorf("invalid header: %+v", r.LzopHeader)
+		}
+		data2, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, data2) {
+			t.Error("data doesn't match for level", level)
+		}
+	}
+}
+
+func TestLzopWriterIncompressible(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var buf bytes.Buffer
+	z := NewLzopWriter(&buf)
+	z.Write(data[:10])
+	z.Write(data[10:])
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewLzopReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data2, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Error("data doesn't match")
+	}
+}
+
+func TestLzopWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewLzopWriter(&buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewLzopReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Error("EOF expected, found:", n, err)
+	}
+}
+
+func TestLzopChecksums(t *testing.T) {
+	data := bytes.Repeat([]byte("checksummed data "), 3000)
+	flags := uint32(LzopFlagAdler32D | LzopFlagAdler32C | LzopFlagCRC32D | LzopFlagCRC32C | LzopFlagHeaderCRC32)
+
+	var buf bytes.Buffer
+	z := NewLzopWriter(&buf)
+	z.Flags |= flags
+	z.BlockSize = 8192
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	r, err := NewLzopReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Flags&flags != flags {
+		t.Errorf("flags not stored: %08x", r.Flags)
+	}
+	data2, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Error("data doesn't match")
+	}
+
+	// Corrupt the last byte of the third block's compressed data, which is
+	// right before the header of the fourth block.
+	pos := bytes.Index(file, lzopMagic[:]) + len(lzopMagic)
+	pos += 2 + 2 + 2 + 1 + 1 + 4 + 4 + 4 + 4 + 1 + 4 // empty name
+	for i := 0; i < 3; i++ {
+		clen := binary.BigEndian.Uint32(file[pos+4:])
+		pos += 8 + 16 + int(clen)
+	}
+	file[pos-1] ^= 0x55
+
+	r, err = NewLzopReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	cerr, ok := err.(*LzopChecksumError)
+	if !ok {
+		t.Fatal("checksum error expected, found:", err)
+	}
+	if cerr.Block != 2 || !cerr.Compressed {
+		t.Error("invalid checksum error:", cerr)
+	}
+}
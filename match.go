@@ -1,9 +1,9 @@
 package lzo
 
-func (ctx *compressor) initMatch(s *swd, flags uint32) {
+func (ctx *compressor) initMatch(s *swd, dict []byte, bestOff bool) {
 	s.ctx = ctx
-	s.init()
-	if flags&1 != 0 {
+	s.init(dict)
+	if bestOff {
 		s.UseBestOff = true
 	}
 }
@@ -45,22 +45,23 @@ func (ctx *compressor) findMatch(s *swd, thislen uint, skip uint) {
 
 func (ctx *compressor) betterMatch(s *swd, imlen, imoff int) (mlen int, moff int) {
 	mlen, moff = imlen, imoff
+	m2MaxOffset, m2MaxLen := ctx.v.m2MaxOffset(), ctx.v.m2MaxLen()
 	if mlen <= m2_MIN_LEN {
 		return
 	}
-	if moff <= m2_MAX_OFFSET {
+	if moff <= m2MaxOffset {
 		return
 	}
 
-	if moff > m2_MAX_OFFSET && mlen >= m2_MIN_LEN+1 && mlen <= m2_MAX_LEN+1 &&
-		s.BestOff[mlen-1] > 0 && s.BestOff[mlen-1] <= m2_MAX_OFFSET {
+	if moff > m2MaxOffset && mlen >= m2_MIN_LEN+1 && mlen <= m2MaxLen+1 &&
+		s.BestOff[mlen-1] > 0 && s.BestOff[mlen-1] <= uint(m2MaxOffset) {
 		mlen -= 1
 		moff = int(s.BestOff[mlen])
 		return
 	}
 
-	if moff > m3_MAX_OFFSET && mlen >= m4_MAX_LEN+1 && mlen <= m2_MAX_LEN+2 &&
-		s.BestOff[mlen-2] > 0 && s.BestOff[mlen-2] <= m2_MAX_OFFSET {
+	if moff > m3_MAX_OFFSET && mlen >= m4_MAX_LEN+1 && mlen <= m2MaxLen+2 &&
+		s.BestOff[mlen-2] > 0 && s.BestOff[mlen-2] <= uint(m2MaxOffset) {
 		mlen -= 2
 		moff = int(s.BestOff[mlen])
 		return
@@ -96,6 +97,19 @@ func (ctx *compressor) assertMatch(s *swd, mlen, moff int) {
 		}
 		assertMemcmp(ctx.in[ctx.bp:], ctx.in[ctx.bp-moff:], mlen)
 	} else {
-		panic("dict should not exit")
+		doff := moff - ctx.bp
+		if doff > len(ctx.dict) {
+			panic("assertMatch: invalid dictionary offset")
+		}
+		dict := ctx.dict[len(ctx.dict)-doff:]
+		if mlen > doff {
+			assertMemcmp(ctx.in[ctx.bp:], dict, doff)
+			if mlen-doff >= ctx.ip {
+				panic("assertMatch: invalid bp")
+			}
+			assertMemcmp(ctx.in[ctx.bp+doff:], ctx.in, mlen-doff)
+		} else {
+			assertMemcmp(ctx.in[ctx.bp:], dict, mlen)
+		}
 	}
 }
@@ -0,0 +1,302 @@
+package lzo
+
+import "io"
+
+// What the parser expects to find after the pending literals and matches
+const (
+	phaseStart      = iota // first instruction of a stream
+	phaseBegin             // after a match not followed by literals
+	phaseAfterRun          // after a literal run of 4 or more bytes
+	phaseAfterShort        // after 1 to 3 literals
+	phaseEnd               // after the terminator
+	phaseNext              // first instruction of a stream, or end of input
+)
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// parser decodes LZO1X instructions (or those of another variant) reading the
+// input one byte at a time, so that it never reads past the end of the
+// stream. The literals are left in the input, and must be consumed with
+// readLiterals before decoding the next instruction; the pending match must
+// be copied by the caller.
+type parser struct {
+	r       byteReader
+	v       variant
+	max     int64 // length of the input, or -1 if unknown
+	phase   int
+	lit     int   // literals to be copied from the input
+	run     int   // length of the pending literal run
+	mlen    int   // length of the pending match
+	mdist   int   // distance of the pending match
+	lastOff int   // distance of the previous match, for LZO1Z
+	out     int64 // size of the data described by the decoded instructions
+	in      int64 // bytes consumed from the input
+	op      int64 // offset of the last opcode
+	opcode  byte
+}
+
+func (p *parser) reset(r byteReader, v variant, max int64) {
+	*p = parser{r: r, v: v, max: max, phase: phaseStart}
+}
+
+func (p *parser) getByte() (byte, error) {
+	if p.in == p.max {
+		return 0, io.EOF
+	}
+	b, err := p.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p.in++
+	return b, nil
+}
+
+// Read a byte in the middle of an instruction
+func (p *parser) readByte() (byte, error) {
+	b, err := p.getByte()
+	if err == io.EOF {
+		err = InputOverrun
+	}
+	return b, err
+}
+
+func (p *parser) readMulti(base int) (int, error) {
+	t := 0
+	for {
+		b, err := p.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0 {
+			return t + int(b) + base, nil
+		}
+		t += 255
+	}
+}
+
+// Decode the next instruction, setting the literals and the match that it
+// describes as pending. It must be called only after they have been
+// consumed.
+func (p *parser) step() error {
+	var t int
+
+	if p.phase == phaseEnd {
+		return io.EOF
+	}
+	p.op, p.opcode = p.in, 0
+	b, err := p.getByte()
+	if err != nil {
+		if err == io.EOF && p.phase != phaseNext {
+			err = EOFNotFound
+		}
+		return err
+	}
+	p.opcode = b
+	t = int(b)
+
+	switch p.phase {
+	case phaseStart, phaseNext:
+		if t > 17 {
+			p.lit = t - 17
+			if p.lit < 4 {
+				p.phase = phaseAfterShort
+			} else {
+				p.phase = phaseAfterRun
+			}
+			p.run = p.lit
+			p.out += int64(p.lit)
+			return nil
+		}
+		fallthrough
+	case phaseBegin:
+		if t < 16 {
+			if t == 0 {
+				if t, err = p.readMulti(15); err != nil {
+					return err
+				}
+			}
+			p.lit = t + 3
+			p.phase = phaseAfterRun
+			p.run = p.lit
+			p.out += int64(p.lit)
+			return nil
+		}
+	case phaseAfterRun, phaseAfterShort:
+		if t < 16 {
+			b, err := p.readByte()
+			if err != nil {
+				return err
+			}
+			state := t & 3
+			if p.v == lzo1z {
+				p.mdist = 1 + t<<6 + int(b)>>2
+				p.lastOff = p.mdist
+				state = int(b & 3)
+			} else {
+				p.mdist = 1 + t>>2 + int(b)<<2
+			}
+			p.mlen = 2
+			if p.phase == phaseAfterRun {
+				p.mdist += p.v.m2MaxOffset()
+				p.lastOff = p.mdist
+				p.mlen = 3
+			}
+			return p.setMatch(state)
+		}
+	}
+
+	var state int
+	if t >= 64 {
+		if p.v == lzo1z && t&0x1f >= 0x1c {
+			if p.lastOff == 0 {
+				return LookBehindOverrun
+			}
+			p.mdist = p.lastOff
+			p.mlen = t>>5 + 1
+			return p.setMatch(t & 3)
+		}
+		b, err := p.readByte()
+		if err != nil {
+			return err
+		}
+		state = t & 3
+		switch p.v {
+		case lzo1x:
+			p.mdist = 1 + (t>>2)&7 + int(b)<<3
+			p.mlen = t>>5 + 1
+		case lzo1y:
+			p.mdist = 1 + (t>>2)&3 + int(b)<<2
+			p.mlen = t>>4 - 1
+		case lzo1z:
+			p.mdist = 1 + (t&0x1f)<<6 + int(b)>>2
+			p.lastOff = p.mdist
+			p.mlen = t>>5 + 1
+			state = int(b & 3)
+		}
+	} else {
+		high := 0
+		if t >= 32 {
+			t &= 31
+			if t == 0 {
+				if t, err = p.readMulti(31); err != nil {
+					return err
+				}
+			}
+		} else {
+			high = (t & 8) << 11
+			t &= 7
+			if t == 0 {
+				if t, err = p.readMulti(7); err != nil {
+					return err
+				}
+			}
+		}
+		b0, err := p.readByte()
+		if err != nil {
+			return err
+		}
+		b1, err := p.readByte()
+		if err != nil {
+			return err
+		}
+		v16 := int(b0) | int(b1)<<8
+		if p.v == lzo1z {
+			v16 = int(b0)<<8 | int(b1)
+		}
+		if high == 0 && b < 32 && v16>>2 == 0 {
+			p.phase = phaseEnd
+			return io.EOF
+		}
+		if b >= 32 {
+			p.mdist = 1 + v16>>2
+		} else {
+			p.mdist = high + v16>>2 + 0x4000
+		}
+		p.lastOff = p.mdist
+		p.mlen = t + 2
+		state = v16 & 3
+	}
+	return p.setMatch(state)
+}
+
+// Prepare to decode a stream following the one just terminated, if the
+// input doesn't end. Its matches cannot reference the previous streams.
+func (p *parser) next() {
+	p.phase = phaseNext
+	p.out = 0
+	p.lastOff = 0
+}
+
+func (p *parser) setMatch(state int) error {
+	if int64(p.mdist) > p.out {
+		return LookBehindOverrun
+	}
+	p.out += int64(p.mlen + state)
+	p.lit = state
+	p.run = state
+	if state > 0 {
+		p.phase = phaseAfterShort
+	} else {
+		p.phase = phaseBegin
+	}
+	return nil
+}
+
+// Report whether the input continues after the end of the stream, within
+// its known length. The byte read to find out is put back if possible.
+func (p *parser) trailing() bool {
+	if p.max < 0 || p.in >= p.max {
+		return false
+	}
+	if _, err := p.r.ReadByte(); err != nil {
+		return false
+	}
+	if s, ok := p.r.(io.ByteScanner); ok {
+		s.UnreadByte()
+	}
+	return true
+}
+
+// Read the pending literals into dst, which must not be larger than p.lit.
+func (p *parser) readLiterals(dst []byte) (int, error) {
+	short := false
+	if p.max >= 0 && int64(len(dst)) > p.max-p.in {
+		dst = dst[:p.max-p.in]
+		short = true
+	}
+	n, err := io.ReadFull(p.r, dst)
+	p.in += int64(n)
+	p.lit -= n
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && short) {
+		err = InputOverrun
+	}
+	if err != nil {
+		// The truncated run is dropped as a whole, like the slice-based
+		// decoder does
+		p.lit = p.run
+	}
+	return n, err
+}
+
+// Skip the pending literals, for decoders that only need their length. If
+// the input length is known, they are not skipped at all when truncated,
+// like the slice-based decoder does.
+func (p *parser) skipLiterals() error {
+	var buf [256]byte
+	if p.max >= 0 && int64(p.lit) > p.max-p.in {
+		return InputOverrun
+	}
+	for p.lit > 0 {
+		n := p.lit
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := p.readLiterals(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package lzo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// Size of the output buffer of Reader, on top of the window of the last
+// m4_MAX_OFFSET bytes that matches can reference.
+const readerBufSize = 32 * 1024
+
+// Reader is an io.Reader that decompresses a LZO1X stream incrementally,
+// with bounded memory: only the last 48 KiB of output (the maximum distance
+// that a match can reference) are kept, plus a small output buffer.
+//
+// If the underlying reader doesn't implement io.ByteReader, it is wrapped in
+// a bufio.Reader, so Reader may read more data than necessary from it (which
+// is returned by Buffered). Otherwise, Reader doesn't read past the end of
+// the stream.
+type Reader struct {
+	p     parser
+	br    *bufio.Reader // wraps the underlying reader, if needed
+	hist  []byte        // window followed by the output buffer
+	wpos  int           // end of the decoded data in hist
+	rpos  int           // end of the data already returned by Read
+	held  int           // bytes before wpos from an unfinished literal run
+	total int64         // number of decoded bytes
+	limit Limit
+	multi bool            // decode concatenated streams
+	ctx   context.Context // checked for cancellation before each fill, if set
+	err   error
+}
+
+// NewReader creates a new Reader decompressing the LZO1X stream read from r.
+func NewReader(r io.Reader) *Reader {
+	z := &Reader{hist: make([]byte, m4_MAX_OFFSET+readerBufSize)}
+	z.Reset(r)
+	return z
+}
+
+// SetLimit sets a limit on the size of the decompressed data, after which
+// Read fails with OutputOverrun. It must be called before the first Read;
+// the limit is retained by Reset.
+func (z *Reader) SetLimit(l Limit) {
+	z.limit = l
+}
+
+// SetContext makes Read and WriteTo fail with a DecompressError wrapping
+// ctx.Err() once the context is canceled, which is checked each time the
+// output buffer is refilled. This permits stopping the decompression of huge
+// streams. The context is retained by Reset.
+func (z *Reader) SetContext(ctx context.Context) {
+	z.ctx = ctx
+}
+
+// Reset discards the Reader's state and makes it equivalent to the result of
+// NewReader, but reading from r, in multistream mode. This permits reusing
+// a Reader rather than allocating a new one. The limit and the context set
+// with SetLimit and SetContext are retained.
+func (z *Reader) Reset(r io.Reader) {
+	if br, ok := r.(byteReader); ok {
+		z.br = nil
+		z.p.reset(br, lzo1x, -1)
+	} else {
+		if z.br != nil {
+			z.br.Reset(r)
+		} else {
+			z.br = bufio.NewReader(r)
+		}
+		z.p.reset(z.br, lzo1x, -1)
+	}
+	z.wpos, z.rpos, z.held = 0, 0, 0
+	z.total = 0
+	z.multi = true
+	z.err = nil
+}
+
+// Multistream controls whether the Reader supports streams concatenated
+// back-to-back, like the output of Writer. If enabled (the default), each
+// stream terminator is followed by another stream, until the underlying
+// reader returns io.EOF; trailing data that is not a valid stream results
+// in an error.
+//
+// If disabled, which must be done before the first Read, Read returns
+// io.EOF at the end of each stream, and NextStream can be used to advance
+// to the following one. This permits processing each stream separately, or
+// reading a stream followed by other data.
+func (z *Reader) Multistream(ok bool) {
+	z.multi = ok
+}
+
+var errNotAtEnd = errors.New("lzo: NextStream called before the end of the stream")
+
+// NextStream prepares to read the stream that follows the current one,
+// after Read has returned io.EOF at its end, when multistream mode is
+// disabled. It returns io.EOF if the underlying reader has no more data.
+// Consumed and the limit set with SetLimit then refer to the new stream.
+func (z *Reader) NextStream() error {
+	if z.err != io.EOF || z.rpos < z.wpos {
+		if z.err != nil && z.err != io.EOF {
+			return z.err
+		}
+		return errNotAtEnd
+	}
+	if z.p.phase == phaseNext {
+		return io.EOF
+	}
+	z.p.reset(z.p.r, lzo1x, -1)
+	z.p.next()
+	z.wpos, z.rpos, z.held = 0, 0, 0
+	z.total = 0
+	z.err = nil
+	z.fill()
+	if z.err == io.EOF && z.p.phase == phaseNext {
+		return io.EOF
+	}
+	return nil
+}
+
+// Consumed returns the number of compressed bytes decoded so far, which
+// after the end of the stream is its length, including the terminator.
+func (z *Reader) Consumed() int64 {
+	return z.p.in
+}
+
+// Buffered returns the data that was read from the underlying reader but not
+// decoded yet, which after the end of the stream is the data that follows
+// it. It is always empty if the underlying reader implements io.ByteReader.
+// The slice is only valid until the next call to Read or WriteTo.
+func (z *Reader) Buffered() []byte {
+	if z.br == nil {
+		return nil
+	}
+	b, _ := z.br.Peek(z.br.Buffered())
+	return b
+}
+
+// Decode data into the output buffer until it is full, or an error (or the
+// end of stream) is found, or more input is needed while there is output
+// that Read can return.
+func (z *Reader) fill() {
+	if err := z.limit.check(); err != nil && z.err == nil {
+		z.err = err
+	}
+	if z.ctx != nil && z.err == nil {
+		if err := z.ctx.Err(); err != nil {
+			z.p.op, z.p.opcode = z.p.in, 0
+			z.err = z.wrapError(err)
+		}
+	}
+	for z.err == nil {
+		if z.wpos == len(z.hist) {
+			if z.rpos < z.wpos-z.held {
+				return
+			}
+			if z.held >= readerBufSize {
+				// The literal run fills the output buffer, so it cannot
+				// be held back until its end
+				z.held = 0
+				return
+			}
+			// Move the window to the beginning of the buffer
+			copy(z.hist, z.hist[z.wpos-m4_MAX_OFFSET:z.wpos])
+			z.wpos = m4_MAX_OFFSET
+			z.rpos = z.wpos - z.held
+		}
+
+		p := &z.p
+		switch {
+		case p.mlen > 0:
+			n := len(z.hist) - z.wpos
+			if n > p.mlen {
+				n = p.mlen
+			}
+			src := z.wpos - p.mdist
+			if p.mdist >= n {
+				copy(z.hist[z.wpos:z.wpos+n], z.hist[src:])
+			} else {
+				for i := 0; i < n; i++ {
+					z.hist[z.wpos+i] = z.hist[src+i]
+				}
+			}
+			z.wpos += n
+			z.total += int64(n)
+			p.mlen -= n
+		case p.lit > 0:
+			n := len(z.hist) - z.wpos
+			if n > p.lit {
+				n = p.lit
+			}
+			m, err := p.readLiterals(z.hist[z.wpos : z.wpos+n])
+			if err != nil {
+				// Drop the part of the run held back
+				z.total -= int64(z.held)
+				z.err = z.wrapError(err)
+				return
+			}
+			z.wpos += m
+			z.total += int64(m)
+			// Until the run is complete, Read doesn't return it, so that
+			// it can be dropped if truncated, like the other decoders do
+			if p.lit > 0 {
+				z.held += m
+			} else {
+				z.held = 0
+			}
+		default:
+			if z.rpos < z.wpos-z.held && z.mayBlock() {
+				// Return the pending output rather than wait for input
+				// that might only be sent after it is consumed
+				return
+			}
+			err := p.step()
+			if err == io.EOF {
+				if p.phase == phaseEnd && z.multi {
+					if z.rpos < z.wpos {
+						// Same for the stream that follows
+						return
+					}
+					p.next()
+					continue
+				}
+				if p.phase == phaseNext && !z.multi {
+					// No stream after the one that NextStream ended
+					z.err = err
+					return
+				}
+			}
+			if err := z.checkLimit(err); err != nil {
+				z.err = z.wrapError(err)
+			}
+		}
+	}
+}
+
+// Whether decoding the next instruction might block on the underlying
+// reader, when no input is buffered.
+func (z *Reader) mayBlock() bool {
+	br := z.br
+	if br == nil {
+		br, _ = z.p.r.(*bufio.Reader)
+	}
+	return br != nil && br.Buffered() == 0
+}
+
+// Check that the data described by the instruction just decoded doesn't
+// exceed the limit, or that the stream that just ended respects it.
+func (z *Reader) checkLimit(err error) error {
+	if z.limit.Max <= 0 && !z.limit.Exact {
+		return err
+	}
+	switch {
+	case err == nil && z.total+int64(z.p.lit+z.p.mlen) > z.limit.Max:
+		return OutputOverrun
+	case err == io.EOF && z.limit.Exact && z.total != z.limit.Max:
+		return OutputUnderrun
+	}
+	return err
+}
+
+func (z *Reader) wrapError(err error) error {
+	if err == io.EOF {
+		return err
+	}
+	return &DecompressError{Err: err, InOffset: z.p.op, OutOffset: z.total, Opcode: z.p.opcode}
+}
+
+// Read implements io.Reader, reading decompressed bytes from the stream.
+// It returns io.EOF once the stream terminator has been decoded. Errors are
+// returned as *DecompressError, after all the data decoded before the
+// failing instruction has been returned. Only a literal run longer than the
+// output buffer can be returned in part before it is found truncated, in
+// which case OutOffset accounts for that part.
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.rpos == z.wpos-z.held {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.fill()
+	}
+	n := copy(p, z.hist[z.rpos:z.wpos-z.held])
+	z.rpos += n
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo, writing all the decompressed data to w.
+func (z *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if z.rpos < z.wpos-z.held {
+			m, err := w.Write(z.hist[z.rpos : z.wpos-z.held])
+			n += int64(m)
+			z.rpos += m
+			if err != nil {
+				return n, err
+			}
+		}
+		if z.err != nil {
+			if z.err == io.EOF {
+				return n, nil
+			}
+			return n, z.err
+		}
+		z.fill()
+	}
+}
+
+// Decompress1XMulti decompresses all the LZO1X streams concatenated in the
+// input, like the output of Writer, until the reader returns io.EOF, and
+// returns their data concatenated. outLen is an optional hint on the size of
+// the output, like in Decompress1X.
+func Decompress1XMulti(r io.Reader, outLen int) ([]byte, error) {
+	z := NewReader(r)
+	var buf bytes.Buffer
+	if outLen > 0 {
+		buf.Grow(outLen)
+	}
+	_, err := z.WriteTo(&buf)
+	return buf.Bytes(), err
+}
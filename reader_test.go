@@ -0,0 +1,276 @@
+package lzo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// Data larger than the Reader's buffer, with matches at every distance the
+// compressors can produce.
+func readerTestData() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	var data []byte
+	for len(data) < 1<<20 {
+		if len(data) > 0xc000 && rnd.Intn(2) == 0 {
+			off := 1 + rnd.Intn(0xbfff)
+			n := 3 + rnd.Intn(300)
+			for i := 0; i < n; i++ {
+				data = append(data, data[len(data)-off])
+			}
+			continue
+		}
+		for i := rnd.Intn(100); i >= 0; i-- {
+			data = append(data, byte('a'+rnd.Intn(4)))
+		}
+	}
+	return data
+}
+
+func TestReader(t *testing.T) {
+	data := readerTestData()
+	for _, cmp := range [][]byte{Compress1X(data), Compress1X999(data)} {
+		data2, err := ioutil.ReadAll(NewReader(bytes.NewReader(cmp)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, data2) {
+			t.Error("data doesn't match with Read")
+		}
+
+		var buf bytes.Buffer
+		if _, err := NewReader(iotest.OneByteReader(bytes.NewReader(cmp))).WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, buf.Bytes()) {
+			t.Error("data doesn't match with WriteTo")
+		}
+	}
+}
+
+func TestReaderSmallReads(t *testing.T) {
+	data := bytes.Repeat([]byte("small reads "), 5000)
+	z := NewReader(bytes.NewReader(Compress1X(data)))
+	data2, err := ioutil.ReadAll(iotest.OneByteReader(z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Error("data doesn't match")
+	}
+
+	// Reset to a stream with trailing data, which must not be consumed
+	// outside of multistream mode
+	r := bytes.NewReader(append(Compress1X([]byte("again")), "trailer"...))
+	z.Reset(r)
+	z.Multistream(false)
+	if data2, err = ioutil.ReadAll(z); err != nil || string(data2) != "again" {
+		t.Error("invalid data after Reset:", data2, err)
+	}
+	if r.Len() != len("trailer") {
+		t.Error("reader consumed data past the end of stream:", r.Len())
+	}
+	if z.Consumed() != int64(len(Compress1X([]byte("again")))) {
+		t.Error("invalid number of consumed bytes:", z.Consumed())
+	}
+
+	// Without a ByteReader, the over-read data is returned by Buffered
+	z.Reset(iotest.HalfReader(bytes.NewReader(append(Compress1X([]byte("again")), "trailer"...))))
+	z.Multistream(false)
+	if data2, err = ioutil.ReadAll(z); err != nil || string(data2) != "again" {
+		t.Error("invalid data after Reset:", data2, err)
+	}
+	if string(z.Buffered()) != "trailer" {
+		t.Errorf("invalid buffered data: %q", z.Buffered())
+	}
+
+	// The buffer is reused by the next Reset
+	br := z.br
+	z.Reset(iotest.HalfReader(bytes.NewReader(Compress1X([]byte("reuse")))))
+	if z.br != br {
+		t.Error("buffer not reused by Reset")
+	}
+	if data2, err = ioutil.ReadAll(z); err != nil || string(data2) != "reuse" {
+		t.Error("invalid data after Reset:", data2, err)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	cmp := Compress1X(readerTestData())
+	for _, n := range []int{0, 1, len(cmp) / 2, len(cmp) - 1} {
+		_, err := io.Copy(ioutil.Discard, NewReader(bytes.NewReader(cmp[:n])))
+		if !errors.Is(err, InputOverrun) && !errors.Is(err, EOFNotFound) {
+			t.Errorf("truncated input error expected at %d, found: %v", n, err)
+		}
+	}
+
+	// Literal runs across the end of the output buffer, one of which is
+	// longer than it
+	rnd := rand.New(rand.NewSource(1))
+	data := bytes.Repeat([]byte("buffered "), 9000)
+	for _, n := range []int{10000, 40000} {
+		for i := 0; i < n; i++ {
+			data = append(data, byte(rnd.Intn(256)))
+		}
+		data = append(data, bytes.Repeat([]byte("buffered "), 9000)...)
+	}
+	cmp = Compress1X(data)
+	for n := len(cmp) / 10; n < len(cmp); n += 97 {
+		out, err := AppendDecompress1X(nil, cmp[:n])
+		want, _ := err.(*DecompressError)
+		out2, err := ioutil.ReadAll(NewReader(bytes.NewReader(cmp[:n])))
+		derr, ok := err.(*DecompressError)
+		if !ok || want == nil {
+			t.Fatalf("truncated input error expected at %d, found: %v", n, err)
+		}
+		if derr.OutOffset != int64(len(out2)) || !bytes.Equal(out2, data[:len(out2)]) {
+			t.Fatalf("at %d, %d bytes returned, output offset %d", n, len(out2), derr.OutOffset)
+		}
+		// Only the longer run can be returned in part
+		if want.OutOffset < 160000 && (*derr != *want || !bytes.Equal(out, out2)) {
+			t.Fatalf("at %d, %v expected, found: %v", n, want, derr)
+		}
+	}
+}
+
+func TestReaderFlush(t *testing.T) {
+	// The data flushed by a Writer is returned without waiting for more
+	for _, wrap := range []func(io.Reader) io.Reader{
+		func(r io.Reader) io.Reader { return r },
+		func(r io.Reader) io.Reader { return bufio.NewReader(r) },
+	} {
+		pr, pw := io.Pipe()
+		w, _ := NewWriter(pw, 0)
+		z := NewReader(wrap(pr))
+		for _, msg := range []string{"first flush, ", "second flush"} {
+			wrote := make(chan error, 1)
+			go func() {
+				w.Write([]byte(msg))
+				wrote <- w.Flush()
+			}()
+			read := make(chan error, 1)
+			buf := make([]byte, len(msg))
+			go func() {
+				_, err := io.ReadFull(z, buf)
+				read <- err
+			}()
+			select {
+			case err := <-read:
+				if err != nil || string(buf) != msg {
+					t.Errorf("invalid flushed data: %q, %v", buf, err)
+				}
+			case <-time.After(5 * time.Second):
+				pw.Close()
+				t.Fatal("Read blocked after Flush")
+			}
+			if err := <-wrote; err != nil {
+				t.Fatal(err)
+			}
+		}
+		pw.Close()
+	}
+}
+
+func TestReaderContext(t *testing.T) {
+	data := readerTestData()
+	cmp := Compress1X(data)
+
+	// Canceled in the middle of the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	z := NewReader(bytes.NewReader(cmp))
+	z.SetContext(ctx)
+	buf := make([]byte, 1000)
+	if _, err := io.ReadFull(z, buf); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	out, err := ioutil.ReadAll(z)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("cancellation expected, found:", err)
+	}
+	out = append(buf, out...)
+	if len(out) >= len(data) || !bytes.Equal(out, data[:len(out)]) {
+		t.Error("invalid data before cancellation:", len(out))
+	}
+
+	// Retained by Reset, and checked by WriteTo
+	z.Reset(bytes.NewReader(cmp))
+	if _, err := z.WriteTo(ioutil.Discard); !errors.Is(err, context.Canceled) {
+		t.Error("cancellation expected from WriteTo, found:", err)
+	}
+	z.SetContext(context.Background())
+	z.Reset(bytes.NewReader(cmp))
+	if _, err := z.WriteTo(ioutil.Discard); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderMultistream(t *testing.T) {
+	data := readerTestData()[:200000]
+	var buf bytes.Buffer
+	w, _ := NewWriterSize(&buf, 0, 64*1024)
+	w.Write(data)
+	w.Close()
+	cmp := buf.Bytes()
+
+	data2, err := Decompress1XMulti(bytes.NewReader(cmp), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Error("data doesn't match with Decompress1XMulti")
+	}
+	// outLen is only a hint
+	if data2, err = Decompress1XMulti(bytes.NewReader(cmp), -1); err != nil || !bytes.Equal(data, data2) {
+		t.Error("data doesn't match with a negative outLen:", err)
+	}
+
+	// Multistream is the default
+	data2, err = ioutil.ReadAll(NewReader(iotest.HalfReader(bytes.NewReader(cmp))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Error("data doesn't match with Reader")
+	}
+
+	// Stream boundaries
+	z := NewReader(iotest.HalfReader(bytes.NewReader(cmp)))
+	z.Multistream(false)
+	var streams [][]byte
+	for {
+		out, err := ioutil.ReadAll(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, out)
+		if err := z.NextStream(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(streams) != 4 || len(streams[0]) != 64*1024 {
+		t.Errorf("invalid streams: %d", len(streams))
+	}
+	if !bytes.Equal(data, bytes.Join(streams, nil)) {
+		t.Error("data doesn't match with NextStream")
+	}
+
+	// Streams cannot reference the data of the previous ones: one literal,
+	// then a match at distance 2
+	bad := append(Compress1X([]byte("first")), 18, 'a', 1<<2, 0, m4_MARKER|1, 0, 0)
+	if _, err := Decompress1XMulti(bytes.NewReader(bad), 0); !errors.Is(err, LookBehindOverrun) {
+		t.Error("lookbehind overrun expected, found:", err)
+	}
+	if _, err := Decompress1XMulti(bytes.NewReader(append(cmp, 0)), 0); !errors.Is(err, InputOverrun) {
+		t.Error("input overrun expected with trailing data, found:", err)
+	}
+}
@@ -42,6 +42,10 @@ type swd struct {
 	nodecount uint
 	firstrp   uint
 
+	// Tables are reused across compressions: used is the length of the
+	// previous input, or -1 if the tables have never been initialized.
+	used int
+
 	b     [cSWD_N + cSWD_F + cSWD_F]byte
 	head3 [cSWD_HSIZE]uint16
 	succ3 [cSWD_N + cSWD_F]uint16
@@ -50,6 +54,10 @@ type swd struct {
 	head2 [65536]uint16
 }
 
+func newSwd() *swd {
+	return &swd{used: -1}
+}
+
 func head2(data []byte) uint {
 	return uint(data[1])<<8 | uint(data[0])
 }
@@ -89,7 +97,9 @@ func (s *swd) removeNode(node uint) {
 	s.nodecount--
 }
 
-func (s *swd) init() {
+// Prepare to compress s.ctx.in, which can reference the preset dictionary
+// dict (at most cSWD_N bytes long).
+func (s *swd) init(dict []byte) {
 	s.SwdN = cSWD_N
 	s.SwdF = cSWD_F
 	s.SwdThreshold = cSWD_THRESHOLD
@@ -100,18 +110,21 @@ func (s *swd) init() {
 	s.bwrap = s.b[s.bsize:]
 	s.nodecount = s.SwdN
 
-	for i := 0; i < len(s.head2); i++ {
-		s.head2[i] = 0xFFFF
-	}
+	s.UseBestOff = false
+	s.MLen, s.MOff = 0, 0
+	s.BestOff = [cSWD_BEST_OFF]uint{}
+	s.clear()
+	s.used = len(dict) + len(s.ctx.in)
 
-	s.ip = 0
+	copy(s.b[:], dict)
+	s.ip = uint(len(dict))
 	s.bp = s.ip
 	s.firstrp = s.ip
 	if s.ip+s.SwdF > s.bsize {
 		panic("assert: swd.init: invalid ip")
 	}
 
-	s.Look = uint(len(s.ctx.in)) - s.ip
+	s.Look = uint(len(s.ctx.in) - s.ctx.ip)
 	if s.Look > 0 {
 		if s.Look > s.SwdF {
 			s.Look = s.SwdF
@@ -125,6 +138,10 @@ func (s *swd) init() {
 		s.ip = 0
 	}
 
+	if s.Look >= 2 && len(dict) > 0 {
+		s.insertDict(0, uint(len(dict)))
+	}
+
 	s.rp = s.firstrp
 	if s.rp >= s.nodecount {
 		s.rp -= s.nodecount
@@ -139,6 +156,52 @@ func (s *swd) init() {
 	}
 }
 
+// Insert the n positions of the dictionary starting at node, as if they had
+// been accepted.
+func (s *swd) insertDict(node uint, n uint) {
+	s.nodecount = s.SwdN - n
+	s.firstrp = node
+
+	for ; n > 0; n-- {
+		key := head3(s.b[node:])
+		s.succ3[node] = s.gethead3(key)
+		s.head3[key] = uint16(node)
+		s.best3[node] = uint16(s.SwdF + 1)
+		s.llen3[key]++
+		if uint(s.llen3[key]) > s.SwdN {
+			panic("swd: insertDict: invalid llen3")
+		}
+
+		key = head2(s.b[node:])
+		s.head2[key] = uint16(node)
+
+		node++
+	}
+}
+
+// Bring the tables back to their initial state. After a short input, the
+// buffer did not wrap around, so it still holds every inserted position
+// (including the one at the end of the input), and only their entries need
+// to be cleared.
+func (s *swd) clear() {
+	if s.used >= 0 && s.used < cSWD_N {
+		for i := 0; i <= s.used; i++ {
+			s.head2[head2(s.b[i:])] = 0xFFFF
+			s.llen3[head3(s.b[i:])] = 0
+			s.best3[i] = 0
+		}
+		return
+	}
+	for i := range s.head2 {
+		s.head2[i] = 0xFFFF
+	}
+	if s.used >= 0 {
+		s.b = [len(s.b)]byte{}
+		s.llen3 = [cSWD_HSIZE]uint16{}
+		s.best3 = [len(s.best3)]uint16{}
+	}
+}
+
 func (s *swd) getbyte() {
 	c := -1
 	if s.ctx.ip < len(s.ctx.in) {
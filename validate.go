@@ -0,0 +1,56 @@
+package lzo
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Validate checks that r contains a valid LZO1X stream, and returns the size
+// of its decompressed data, without materializing it: it decodes every
+// instruction, and checks that its literals are present and that its match
+// only references data before it, using a small constant amount of memory.
+//
+// Errors are reported like in Decompress1X, and n is the size of the data
+// that can be decompressed before the failure. If r implements
+// io.ByteReader, it is left positioned right after the stream terminator;
+// otherwise, more data might be read from it.
+func Validate(r io.Reader) (n int64, err error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	var p parser
+	p.reset(br, lzo1x, -1)
+	return validate(&p)
+}
+
+// DecompressedSize is like Validate, for the LZO1X stream in src. Like
+// AppendDecompress1X, it returns InputNotConsumed if src continues after
+// the stream.
+func DecompressedSize(src []byte) (int, error) {
+	var p parser
+	p.reset(bytes.NewReader(src), lzo1x, int64(len(src)))
+	n, err := validate(&p)
+	if err == nil && p.in < int64(len(src)) {
+		err = &DecompressError{Err: InputNotConsumed, InOffset: p.op, OutOffset: n, Opcode: p.opcode}
+	}
+	return int(n), err
+}
+
+func validate(p *parser) (int64, error) {
+	for {
+		err := p.step()
+		p.mlen = 0
+		if err == nil {
+			err = p.skipLiterals()
+		}
+		if err == io.EOF {
+			return p.out, nil
+		}
+		if err != nil {
+			n := p.out - int64(p.lit)
+			return n, &DecompressError{Err: err, InOffset: p.op, OutOffset: n, Opcode: p.opcode}
+		}
+	}
+}
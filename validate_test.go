@@ -0,0 +1,40 @@
+package lzo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+)
+
+func TestValidate(t *testing.T) {
+	data := readerTestData()
+	for _, cmp := range [][]byte{Compress1X(data), Compress1X999(data)} {
+		n, err := DecompressedSize(cmp)
+		if err != nil || n != len(data) {
+			t.Errorf("invalid size from DecompressedSize: %d, %v", n, err)
+		}
+		n64, err := Validate(iotest.OneByteReader(bytes.NewReader(cmp)))
+		if err != nil || n64 != int64(len(data)) {
+			t.Errorf("invalid size from Validate: %d, %v", n64, err)
+		}
+
+		// Errors are positioned like the decompressors'
+		for _, i := range []int{1, len(cmp) / 3, len(cmp) / 2, len(cmp) - 2} {
+			bad := append([]byte(nil), cmp...)
+			bad[i] ^= 0x55
+			out, err1 := AppendDecompress1X(nil, bad)
+			n, err2 := DecompressedSize(bad)
+			if err1 == nil {
+				continue
+			}
+			var derr1, derr2 *DecompressError
+			if !errors.As(err1, &derr1) || !errors.As(err2, &derr2) || *derr1 != *derr2 {
+				t.Errorf("corruption at %d: %v expected, found: %v", i, err1, err2)
+			}
+			if n != len(out) {
+				t.Errorf("corruption at %d: size %d expected, found: %d", i, len(out), n)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package lzo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultBlockSize is the amount of data that Writer compresses at once,
+// unless configured otherwise.
+const DefaultBlockSize = 256 * 1024
+
+// Writer is an io.WriteCloser that compresses data incrementally.
+//
+// LZO1X cannot represent a literal run that is not followed by a match, so a
+// compressed stream cannot be cut at arbitrary points. Writer thus buffers
+// up to a block of data, and writes each block as a complete LZO1X stream,
+// terminator included. The output is a sequence of independent LZO1X
+// streams, each of which can be decompressed with Decompress1X; as soon as
+// more than one block is written, Decompress1XMulti or a Reader are needed
+// to decompress all of them at once.
+type Writer struct {
+	w         io.Writer
+	level     Level
+	blockSize int
+	c1        Compressor1X
+	c999      *Compressor999
+	buf       []byte
+	out       []byte
+	wrote     bool
+	closed    bool
+	err       error
+}
+
+// NewWriter creates a new Writer writing to w. Level 0 selects LZO1X-1,
+// while levels 1 to 9 select LZO1X-999 with that compression level.
+func NewWriter(w io.Writer, level Level) (*Writer, error) {
+	return NewWriterSize(w, level, DefaultBlockSize)
+}
+
+// NewWriterSize is like NewWriter, but compresses data in blocks of the
+// specified size. Larger blocks give better compression, as matches cannot
+// span across blocks, at the cost of more memory.
+func NewWriterSize(w io.Writer, level Level, blockSize int) (*Writer, error) {
+	if err := level.check(BestSpeed); err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("lzo: invalid block size: %d", blockSize)
+	}
+	z := &Writer{level: level, blockSize: blockSize}
+	if level > 0 {
+		z.c999, _ = NewCompressor999(level)
+	}
+	z.Reset(w)
+	return z, nil
+}
+
+// Reset discards the writer's state and makes it equivalent to the result
+// of NewWriter, with the same level and block size, but writing to w. Data
+// that was not flushed is discarded.
+func (z *Writer) Reset(w io.Writer) {
+	z.w = w
+	z.buf = z.buf[:0]
+	z.wrote = false
+	z.closed = false
+	z.err = nil
+}
+
+func (z *Writer) writeBlock() error {
+	if z.level == 0 {
+		z.out = z.c1.AppendCompress(z.out[:0], z.buf)
+	} else {
+		z.out = z.c999.AppendCompress(z.out[:0], z.buf)
+	}
+	z.buf = z.buf[:0]
+	z.wrote = true
+	_, err := z.w.Write(z.out)
+	return err
+}
+
+// Write compresses p, writing a block to the underlying writer each time
+// the block size is reached.
+func (z *Writer) Write(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errors.New("lzo: write on closed writer")
+	}
+	for len(p) > 0 {
+		m := z.blockSize - len(z.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		z.buf = append(z.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(z.buf) == z.blockSize {
+			if z.err = z.writeBlock(); z.err != nil {
+				return n, z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush compresses any pending data and writes it to the underlying writer,
+// terminating the current stream, so that everything written so far can be
+// decompressed. Flushing often reduces the compression ratio, as every
+// block is compressed independently.
+func (z *Writer) Flush() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.closed {
+		return errors.New("lzo: flush on closed writer")
+	}
+	if len(z.buf) > 0 {
+		z.err = z.writeBlock()
+	}
+	return z.err
+}
+
+// Close flushes any pending data. It does not close the underlying writer.
+//
+// If no data was written at all, Close writes an empty stream, so that the
+// output of a Writer can always be decompressed.
+func (z *Writer) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	z.closed = true
+	if len(z.buf) > 0 || !z.wrote {
+		z.err = z.writeBlock()
+	}
+	return z.err
+}
@@ -0,0 +1,99 @@
+package lzo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("streaming compressor "), 10000)
+	for _, level := range []Level{0, 5} {
+		var buf bytes.Buffer
+		z, err := NewWriter(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := z.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		cmp := buf.Bytes()
+		data2, err := Decompress1X(bytes.NewReader(cmp), len(cmp), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, data2) {
+			t.Error("data doesn't match for level", level)
+		}
+		data2, err = ioutil.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, data2) {
+			t.Error("data doesn't match with Reader for level", level)
+		}
+	}
+}
+
+func TestWriterMultiBlock(t *testing.T) {
+	// Several blocks, the last one partial
+	data := readerTestData()[:3*DefaultBlockSize+1000]
+	for _, level := range []Level{0, 1} {
+		var buf bytes.Buffer
+		z, err := NewWriter(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := z.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data2, err := Decompress1XMulti(bytes.NewReader(buf.Bytes()), len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, data2) {
+			t.Error("data doesn't match for level", level)
+		}
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	z, _ := NewWriterSize(&buf, 0, 1024)
+
+	z.Write([]byte("hello, "))
+	if buf.Len() != 0 {
+		t.Error("data written before flush")
+	}
+	if err := z.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	first := buf.Len()
+	out, err := Decompress1X(bytes.NewReader(buf.Bytes()), first, 0)
+	if err != nil || string(out) != "hello, " {
+		t.Error("flushed data not decodable:", out, err)
+	}
+
+	z.Write([]byte("world"))
+	z.Close()
+	out, err = Decompress1X(bytes.NewReader(buf.Bytes()[first:]), buf.Len()-first, 0)
+	if err != nil || string(out) != "world" {
+		t.Error("second stream not decodable:", out, err)
+	}
+
+	buf.Reset()
+	z.Reset(&buf)
+	z.Close()
+	out, err = Decompress1X(bytes.NewReader(buf.Bytes()), buf.Len(), 0)
+	if err != nil || len(out) != 0 {
+		t.Error("empty stream expected after Reset:", out, err)
+	}
+}